@@ -1,11 +1,13 @@
 package snowflake_client
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/pion/webrtc/v4"
 	. "github.com/smartystreets/goconvey/convey"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
 )
@@ -170,6 +172,61 @@ func TestSnowflakeClient(t *testing.T) {
 
 }
 
+// FakeCollector is a SnowflakeCollector whose Collect returns each of errs in
+// turn, then nil.
+type FakeCollector struct {
+	errs     []error
+	collects int
+	melted   chan struct{}
+}
+
+func (f *FakeCollector) Collect() (*WebRTCPeer, error) {
+	f.collects++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return &WebRTCPeer{closed: make(chan struct{})}, nil
+}
+
+func (f *FakeCollector) Pop() *WebRTCPeer { return nil }
+
+func (f *FakeCollector) Melted() <-chan struct{} { return f.melted }
+
+func TestConnectLoop(t *testing.T) {
+	failed := errors.New("failed")
+	atCapacity := fmt.Errorf("%w [1/1]", errAtCapacity)
+	Convey("connectLoop", t, func() {
+		collector := &FakeCollector{melted: make(chan struct{})}
+		gaveUp := false
+		giveUp := func() { gaveUp = true }
+
+		Convey("gives up after consecutive failures", func() {
+			collector.errs = []error{failed, failed, failed}
+			connectLoop(collector, time.Millisecond, 3, giveUp)
+			So(gaveUp, ShouldBeTrue)
+			So(collector.collects, ShouldEqual, 3)
+		})
+		Convey("does not count being at capacity as a failure", func() {
+			// Being at capacity resets the count, and successes do too.
+			collector.errs = []error{failed, failed, atCapacity, failed, failed, nil, atCapacity, failed, failed, failed}
+			connectLoop(collector, time.Millisecond, 3, giveUp)
+			So(gaveUp, ShouldBeTrue)
+			So(collector.collects, ShouldEqual, 10)
+		})
+		Convey("retries forever without a maximum", func() {
+			collector.errs = []error{failed, failed, failed, failed}
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				close(collector.melted)
+			}()
+			connectLoop(collector, time.Millisecond, 0, giveUp)
+			So(gaveUp, ShouldBeFalse)
+		})
+	})
+}
+
 func TestWebRTCPeer(t *testing.T) {
 	Convey("WebRTCPeer", t, func(c C) {
 		p := &WebRTCPeer{closed: make(chan struct{}),
@@ -179,6 +236,36 @@ func TestWebRTCPeer(t *testing.T) {
 			<-time.After(2 * time.Second)
 			So(p.Closed(), ShouldEqual, true)
 		})
+		Convey("reports why it closed, once", func() {
+			var reasons []error
+			p.onClosed = func(reason error) {
+				reasons = append(reasons, reason)
+			}
+			go p.checkForStaleness(time.Second)
+			<-time.After(2 * time.Second)
+			p.Close()
+			So(reasons, ShouldResemble, []error{ErrPeerStale})
+		})
+		Convey("reports stats", func() {
+			p.id = "snowflake-test"
+			stats := p.Stats()
+			So(stats.ID, ShouldEqual, "snowflake-test")
+			So(stats.InboundBytes, ShouldEqual, 0)
+			So(stats.OutboundBytes, ShouldEqual, 0)
+			So(stats.DataChannelState, ShouldEqual, webrtc.DataChannelStateUnknown)
+		})
+		Convey("selects the channel Write sends on", func() {
+			So(p.WriteChannel(), ShouldEqual, DataChannelControl)
+			So(p.SetWriteChannel(DataChannelBulk), ShouldNotBeNil)
+			So(p.WriteChannel(), ShouldEqual, DataChannelControl)
+
+			p.dualDataChannels = true
+			So(p.SetWriteChannel(DataChannelBulk), ShouldBeNil)
+			So(p.WriteChannel(), ShouldEqual, DataChannelBulk)
+			So(p.SetWriteChannel(DataChannelKind(5)), ShouldNotBeNil)
+			So(p.SetWriteChannel(DataChannelControl), ShouldBeNil)
+			So(p.WriteChannel(), ShouldEqual, DataChannelControl)
+		})
 	})
 }
 
@@ -8,6 +8,10 @@ import (
 	"sync"
 )
 
+// errAtCapacity is returned by Collect when the maximum number of snowflakes
+// has already been collected.
+var errAtCapacity = errors.New("At capacity")
+
 // Peers is a container that keeps track of multiple WebRTC remote peers.
 // Implements |SnowflakeCollector|.
 //
@@ -63,7 +67,7 @@ func (p *Peers) Collect() (*WebRTCPeer, error) {
 	capacity := p.Tongue.GetMax()
 	s := fmt.Sprintf("Currently at [%d/%d]", cnt, capacity)
 	if cnt >= capacity {
-		return nil, fmt.Errorf("At capacity [%d/%d]", cnt, capacity)
+		return nil, fmt.Errorf("%w [%d/%d]", errAtCapacity, cnt, capacity)
 	}
 	log.Println("WebRTC: Collecting a new Snowflake.", s)
 	// BUG: some broker conflict here.
@@ -90,7 +90,10 @@ func newBrokerChannelFromConfig(config ClientConfig) (*BrokerChannel, error) {
 
 	var rendezvous RendezvousMethod
 	var err error
-	if config.SQSQueueURL != "" {
+	if config.RendezvousMethod != nil {
+		log.Println("Through a custom rendezvous method")
+		rendezvous = config.RendezvousMethod
+	} else if config.SQSQueueURL != "" {
 		if config.AmpCacheURL != "" || config.BrokerURL != "" {
 			log.Fatalln("Multiple rendezvous methods specified. " + rendezvousErrorMsg)
 		}
@@ -107,6 +110,19 @@ func newBrokerChannelFromConfig(config ClientConfig) (*BrokerChannel, error) {
 	} else if config.BrokerURL != "" {
 		rendezvous, err = newHTTPRendezvous(
 			config.BrokerURL, config.FrontDomains, brokerTransport)
+		if err == nil && len(config.ExtraBrokerURLs) != 0 {
+			log.Println("Racing offers against extra brokers at:", config.ExtraBrokerURLs)
+			methods := []RendezvousMethod{rendezvous}
+			for _, brokerURL := range config.ExtraBrokerURLs {
+				var method RendezvousMethod
+				method, err = newHTTPRendezvous(brokerURL, config.FrontDomains, brokerTransport)
+				if err != nil {
+					break
+				}
+				methods = append(methods, method)
+			}
+			rendezvous = NewMultiRendezvous(methods...)
+		}
 	} else {
 		log.Fatalln("No rendezvous method was specified. " + rendezvousErrorMsg)
 	}
@@ -179,6 +195,17 @@ type WebRTCDialer struct {
 
 	eventLogger event.SnowflakeEventReceiver
 	proxy       *url.URL
+
+	// SnowflakeTimeout, if non-zero, overrides the package-level
+	// SnowflakeTimeout for the peers caught by this dialer.
+	SnowflakeTimeout time.Duration
+	// KeepAliveInterval, if non-zero, makes the peers caught by this dialer
+	// send a keepalive message whenever they have not written anything for
+	// that long.
+	KeepAliveInterval time.Duration
+	// ICEGatheringTimeout, if non-zero, overrides the package-level
+	// ICEGatheringTimeout for the peers caught by this dialer.
+	ICEGatheringTimeout time.Duration
 }
 
 // Deprecated: Use NewWebRTCDialerWithEventsAndProxy instead
@@ -213,7 +240,13 @@ func NewWebRTCDialerWithEventsAndProxy(broker *BrokerChannel, iceServers []webrt
 func (w WebRTCDialer) Catch() (*WebRTCPeer, error) {
 	// TODO: [#25591] Fetch ICE server information from Broker.
 	// TODO: [#25596] Consider TURN servers here too.
-	return NewWebRTCPeerWithEventsAndProxy(w.webrtcConfig, w.BrokerChannel, w.eventLogger, w.proxy)
+	return NewWebRTCPeerWithOptions(w.webrtcConfig, w.BrokerChannel, WebRTCPeerOptions{
+		EventsLogger:        w.eventLogger,
+		Proxy:               w.proxy,
+		SnowflakeTimeout:    w.SnowflakeTimeout,
+		KeepAliveInterval:   w.KeepAliveInterval,
+		ICEGatheringTimeout: w.ICEGatheringTimeout,
+	})
 }
 
 // GetMax returns the maximum number of snowflakes to collect.
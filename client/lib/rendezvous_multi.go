@@ -0,0 +1,82 @@
+package snowflake_client
+
+import (
+	"errors"
+	"log"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+)
+
+// multiRendezvous is a RendezvousMethod that sends each client poll request
+// through several other RendezvousMethods at once, typically each to a
+// different broker, and returns the first response that carries an answer. An
+// outage of any one broker therefore does not block the rendezvous.
+type multiRendezvous struct {
+	methods []RendezvousMethod
+}
+
+// NewMultiRendezvous returns a RendezvousMethod that races every exchange
+// across methods and returns the first response with an answer. If none of
+// them has an answer, it returns a response with the broker's error if any
+// broker replied, or else the first error.
+//
+// RendezvousMethod.Exchange cannot be cancelled, so the exchanges that lose
+// the race run to completion in the background and their results are
+// discarded. A proxy matched by a losing broker times out waiting for the
+// client, like when a client goes away.
+func NewMultiRendezvous(methods ...RendezvousMethod) RendezvousMethod {
+	if len(methods) == 1 {
+		return methods[0]
+	}
+	return &multiRendezvous{methods: methods}
+}
+
+type exchangeResult struct {
+	encPollResp []byte
+	err         error
+}
+
+func (r *multiRendezvous) Exchange(encPollReq []byte) ([]byte, error) {
+	if len(r.methods) == 0 {
+		return nil, errors.New("no rendezvous methods")
+	}
+	log.Printf("Negotiating through %d rendezvous methods...", len(r.methods))
+
+	// The channel is buffered so that the exchanges that lose the race do
+	// not block forever.
+	results := make(chan exchangeResult, len(r.methods))
+	for _, method := range r.methods {
+		go func(method RendezvousMethod) {
+			encPollResp, err := method.Exchange(encPollReq)
+			results <- exchangeResult{encPollResp, err}
+		}(method)
+	}
+
+	var noAnswer []byte
+	var firstErr error
+	for range r.methods {
+		result := <-results
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		resp, err := messages.DecodeClientPollResponse(result.encPollResp)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if resp.Error != "" {
+			noAnswer = result.encPollResp
+			continue
+		}
+		return result.encPollResp, nil
+	}
+	if noAnswer != nil {
+		return noAnswer, nil
+	}
+	return nil, firstErr
+}
@@ -390,6 +390,18 @@ func TestSQSRendezvous(t *testing.T) {
 	})
 }
 
+// fakeRendezvous's Exchange method records the request and returns a fixed
+// response.
+type fakeRendezvous struct {
+	request  []byte
+	response []byte
+}
+
+func (r *fakeRendezvous) Exchange(encPollReq []byte) ([]byte, error) {
+	r.request = encPollReq
+	return r.response, nil
+}
+
 func TestBrokerChannel(t *testing.T) {
 	Convey("Requests a proxy and handles response", t, func() {
 		answerSdp := &webrtc.SessionDescription{
@@ -436,4 +448,88 @@ func TestBrokerChannel(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(requestSdp, ShouldEqual, offerSdp)
 	})
+	Convey("Uses a custom rendezvous method", t, func() {
+		answerSdp := &webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  "test",
+		}
+		answerSdpStr, _ := util.SerializeSessionDescription(answerSdp)
+		rendezvous := &fakeRendezvous{response: makeEncPollResp(answerSdpStr, "")}
+
+		brokerChannel, err := newBrokerChannelFromConfig(ClientConfig{
+			BrokerURL:        "https://broker.example/",
+			RendezvousMethod: rendezvous,
+		})
+		So(err, ShouldBeNil)
+		So(brokerChannel.Rendezvous, ShouldEqual, rendezvous)
+
+		offerSdp := &webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  "test",
+		}
+		answerSdpReturned, err := brokerChannel.Negotiate(offerSdp)
+		So(err, ShouldBeNil)
+		So(answerSdpReturned, ShouldEqual, answerSdp)
+		pollReq, err := messages.DecodeClientPollRequest(rendezvous.request)
+		So(err, ShouldBeNil)
+		So(pollReq.NAT, ShouldEqual, nat.NATUnknown)
+	})
+}
+
+// exchangeFunc is a RendezvousMethod that calls itself.
+type exchangeFunc func([]byte) ([]byte, error)
+
+func (f exchangeFunc) Exchange(encPollReq []byte) ([]byte, error) {
+	return f(encPollReq)
+}
+
+func TestMultiRendezvous(t *testing.T) {
+	Convey("Multi rendezvous", t, func() {
+		answer := makeEncPollResp(`{"type":"answer","sdp":"test"}`, "")
+		noProxies := makeEncPollResp("", "no snowflake proxies currently available")
+		failing := exchangeFunc(func([]byte) ([]byte, error) {
+			return nil, errors.New("broker down")
+		})
+		unmatched := exchangeFunc(func([]byte) ([]byte, error) {
+			return noProxies, nil
+		})
+		block := make(chan struct{})
+		defer close(block)
+		blocked := exchangeFunc(func([]byte) ([]byte, error) {
+			<-block
+			return answer, nil
+		})
+
+		Convey("returns the first answer without waiting for the others", func() {
+			matched := &fakeRendezvous{response: answer}
+			r := NewMultiRendezvous(failing, unmatched, blocked, matched)
+			resp, err := r.Exchange(fakeEncPollReq)
+			So(err, ShouldBeNil)
+			So(resp, ShouldResemble, answer)
+			So(matched.request, ShouldResemble, fakeEncPollReq)
+		})
+
+		Convey("returns the broker's error if no broker has an answer", func() {
+			r := NewMultiRendezvous(failing, unmatched)
+			resp, err := r.Exchange(fakeEncPollReq)
+			So(err, ShouldBeNil)
+			So(resp, ShouldResemble, noProxies)
+		})
+
+		Convey("fails if every exchange fails", func() {
+			r := NewMultiRendezvous(failing, failing)
+			_, err := r.Exchange(fakeEncPollReq)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("is built from extra broker URLs", func() {
+			brokerChannel, err := newBrokerChannelFromConfig(ClientConfig{
+				BrokerURL:       "https://broker.example/",
+				ExtraBrokerURLs: []string{"https://broker2.example/"},
+			})
+			So(err, ShouldBeNil)
+			So(brokerChannel.Rendezvous, ShouldHaveSameTypeAs, &multiRendezvous{})
+			So(brokerChannel.Rendezvous.(*multiRendezvous).methods, ShouldHaveLength, 2)
+		})
+	})
 }
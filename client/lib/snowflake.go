@@ -57,6 +57,9 @@ const (
 	// DataChannelTimeout is how long the client will wait for the OnOpen callback
 	// on a newly created DataChannel.
 	DataChannelTimeout = 10 * time.Second
+	// ICEGatheringTimeout is how long the client will wait for ICE candidate
+	// gathering to complete before giving up on a new snowflake.
+	ICEGatheringTimeout = 10 * time.Second
 
 	// WindowSize is the number of packets in the send and receive window of a KCP connection.
 	WindowSize = 65535
@@ -77,12 +80,23 @@ type Transport struct {
 	// EventDispatcher is the event bus for snowflake events.
 	// When an important event happens, it will be distributed here.
 	eventDispatcher event.SnowflakeEventDispatcher
+
+	// maxCollectAttempts is the number of consecutive failed attempts to
+	// collect a snowflake after which a connection gives up. Zero means no limit.
+	maxCollectAttempts int
+	// onPacketDrop, if set, is called when a packet is dropped.
+	onPacketDrop func(direction string)
 }
 
 // ClientConfig defines how the SnowflakeClient will connect to the broker and Snowflake proxies.
 type ClientConfig struct {
 	// BrokerURL is the full URL of the Snowflake broker that the client will connect to.
 	BrokerURL string
+	// ExtraBrokerURLs are the full URLs of other Snowflake brokers. When set,
+	// and neither AmpCacheURL nor SQSQueueURL is, each offer is sent to
+	// BrokerURL and to every extra broker at once, over HTTP with the same
+	// front domains, and the first answer is used.
+	ExtraBrokerURLs []string
 	// AmpCacheURL is the full URL of a valid AMP cache. A nonzero value indicates
 	// that AMP cache will be used as the rendezvous method with the broker.
 	AmpCacheURL string
@@ -118,6 +132,32 @@ type ClientConfig struct {
 	BridgeFingerprint string
 	// CommunicationProxy is the proxy address for network communication
 	CommunicationProxy *url.URL
+	// RendezvousMethod, if not nil, is used to communicate with the broker
+	// instead of the rendezvous method selected by BrokerURL, AmpCacheURL
+	// and SQSQueueURL.
+	RendezvousMethod RendezvousMethod
+	// MaxCollectAttempts is the number of consecutive failed attempts to
+	// connect to a snowflake proxy, made ReconnectTimeout apart, after which a
+	// connection returned by Dial gives up and fails, letting the caller fall
+	// back to another transport. Zero, the default, means to retry forever.
+	MaxCollectAttempts int
+	// SnowflakeTimeout is how long a snowflake may go without receiving
+	// messages before the client closes it. If zero, the package-level
+	// SnowflakeTimeout is used.
+	SnowflakeTimeout time.Duration
+	// KeepAliveInterval, if non-zero, makes the client send a small keepalive
+	// message on a snowflake that has not sent anything for that long, so that
+	// idle connections are not closed by the proxy. The server discards these
+	// messages. Zero, the default, disables keepalives.
+	KeepAliveInterval time.Duration
+	// ICEGatheringTimeout is how long the client waits for ICE candidate
+	// gathering to complete when connecting to a snowflake. If zero, the
+	// package-level ICEGatheringTimeout is used.
+	ICEGatheringTimeout time.Duration
+	// OnPacketDrop, if set, is called every time a packet is dropped because
+	// the client's send or receive queue is full, with turbotunnel.DropSend
+	// or turbotunnel.DropRecv as the direction.
+	OnPacketDrop func(direction string)
 }
 
 // NewSnowflakeClient creates a new Snowflake transport client that can spawn multiple
@@ -161,7 +201,16 @@ func NewSnowflakeClient(config ClientConfig) (*Transport, error) {
 		max = config.Max
 	}
 	eventsLogger := event.NewSnowflakeEventDispatcher()
-	transport := &Transport{dialer: NewWebRTCDialerWithEventsAndProxy(broker, iceServers, max, eventsLogger, config.CommunicationProxy), eventDispatcher: eventsLogger}
+	dialer := NewWebRTCDialerWithEventsAndProxy(broker, iceServers, max, eventsLogger, config.CommunicationProxy)
+	dialer.SnowflakeTimeout = config.SnowflakeTimeout
+	dialer.KeepAliveInterval = config.KeepAliveInterval
+	dialer.ICEGatheringTimeout = config.ICEGatheringTimeout
+	transport := &Transport{
+		dialer:             dialer,
+		eventDispatcher:    eventsLogger,
+		maxCollectAttempts: config.MaxCollectAttempts,
+		onPacketDrop:       config.OnPacketDrop,
+	}
 
 	return transport, nil
 }
@@ -191,11 +240,11 @@ func (t *Transport) Dial() (net.Conn, error) {
 	snowflakes.bytesLogger = newBytesSyncLogger()
 
 	log.Printf("---- SnowflakeConn: begin collecting snowflakes ---")
-	go connectLoop(snowflakes)
+	go connectLoop(snowflakes, ReconnectTimeout, t.maxCollectAttempts, snowflakes.End)
 
 	// Create a new smux session
 	log.Printf("---- SnowflakeConn: starting a new session ---")
-	pconn, sess, err := newSession(snowflakes)
+	pconn, sess, err := newSession(snowflakes, t.onPacketDrop)
 	if err != nil {
 		return nil, err
 	}
@@ -320,8 +369,9 @@ func parseIceServers(addresses []string) []webrtc.ICEServer {
 
 // newSession returns a new smux.Session and the net.PacketConn it is running
 // over. The net.PacketConn successively connects through Snowflake proxies
-// pulled from snowflakes.
-func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, error) {
+// pulled from snowflakes. If onPacketDrop is not nil, it is called for every
+// packet dropped because a queue is full.
+func newSession(snowflakes SnowflakeCollector, onPacketDrop func(direction string)) (net.PacketConn, *smux.Session, error) {
 	clientID := turbotunnel.NewClientID()
 
 	// We build a persistent KCP session on a sequence of ephemeral WebRTC
@@ -350,6 +400,9 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 		return newEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, conn), nil
 	}
 	pconn := turbotunnel.NewRedialPacketConn(dummyAddr{}, dummyAddr{}, dialContext)
+	if onPacketDrop != nil {
+		pconn.SetDropHook(onPacketDrop)
+	}
 
 	// conn is built on the underlying RedialPacketConn—when one WebRTC
 	// connection dies, another one will be found to take its place. The
@@ -390,13 +443,28 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 }
 
 // Maintain |SnowflakeCapacity| number of available WebRTC connections, to
-// transfer to the Tor SOCKS handler when needed.
-func connectLoop(snowflakes SnowflakeCollector) {
+// transfer to the Tor SOCKS handler when needed, collecting one every
+// interval.
+// If maxAttempts is non-zero, giveUp is called and the loop stops after that
+// many consecutive failures to collect a snowflake.
+func connectLoop(snowflakes SnowflakeCollector, interval time.Duration, maxAttempts int, giveUp func()) {
+	failures := 0
 	for {
-		timer := time.After(ReconnectTimeout)
+		timer := time.After(interval)
 		_, err := snowflakes.Collect()
-		if err != nil {
+		if err != nil && !errors.Is(err, errAtCapacity) {
+			failures++
+			if maxAttempts > 0 && failures >= maxAttempts {
+				log.Printf("WebRTC: %v  Giving up after %d attempts.", err, failures)
+				giveUp()
+				return
+			}
 			log.Printf("WebRTC: %v  Retrying...", err)
+		} else {
+			if err != nil {
+				log.Printf("WebRTC: %v  Retrying...", err)
+			}
+			failures = 0
 		}
 		select {
 		case <-timer:
@@ -1,14 +1,17 @@
 package snowflake_client
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/ice/v4"
@@ -16,33 +19,163 @@ import (
 	"github.com/pion/transport/v3/stdnet"
 	"github.com/pion/webrtc/v4"
 
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/encapsulation"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/proxy"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/util"
 )
 
+// keepAlivePaddingSize is the size of the padding chunk sent as a keepalive.
+const keepAlivePaddingSize = 1
+
+// Reasons passed to WebRTCPeerOptions.OnClosed.
+var (
+	// ErrPeerStale means that no messages were received for too long.
+	ErrPeerStale = errors.New("no messages received, closing stale connection")
+	// ErrPeerClosedRemotely means that the snowflake proxy closed the data
+	// channel.
+	ErrPeerClosedRemotely = errors.New("data channel closed by the remote peer")
+	// ErrPeerClosedLocally means that Close was called.
+	ErrPeerClosedLocally = errors.New("peer closed locally")
+	// ErrICEGatheringTimeout means that ICE candidate gathering did not
+	// complete within the ICE gathering timeout.
+	ErrICEGatheringTimeout = errors.New("timeout waiting for ICE candidate gathering")
+	// ErrICEFailed means that ICE found no working candidate pair to the
+	// snowflake proxy while connecting.
+	ErrICEFailed = errors.New("ICE connection failed")
+)
+
+// DataChannelKind identifies one of the data channels of a WebRTCPeer.
+type DataChannelKind int
+
+const (
+	// DataChannelControl is the ordered, reliable data channel that every
+	// peer has.
+	DataChannelControl DataChannelKind = iota
+	// DataChannelBulk is the unordered, unreliable data channel that a peer
+	// has if WebRTCPeerOptions.DualDataChannels is set.
+	DataChannelBulk
+)
+
+func (k DataChannelKind) String() string {
+	switch k {
+	case DataChannelControl:
+		return "control"
+	case DataChannelBulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("DataChannelKind(%d)", int(k))
+	}
+}
+
 // WebRTCPeer represents a WebRTC connection to a remote snowflake proxy.
 //
-// Each WebRTCPeer only ever has one DataChannel that is used as the peer's transport.
+// Each WebRTCPeer has a control DataChannel that is used as the peer's
+// transport, and optionally a bulk DataChannel. Messages received on either
+// are read with Read, and Write sends on the channel given by WriteChannel.
 type WebRTCPeer struct {
 	id        string
 	pc        *webrtc.PeerConnection
 	transport *webrtc.DataChannel
+	// bulk is the bulk data channel, if dualDataChannels is set.
+	bulk *webrtc.DataChannel
 
 	recvPipe  *io.PipeReader
 	writePipe *io.PipeWriter
 
-	mu          sync.Mutex // protects the following:
-	lastReceive time.Time
+	mu            sync.Mutex // protects the following:
+	lastReceive   time.Time
+	lastWrite     time.Time
+	inboundBytes  int64
+	outboundBytes int64
+	writeChannel  DataChannelKind
 
-	open   chan struct{} // Channel to notify when datachannel opens
-	closed chan struct{}
+	open         chan struct{} // Channel to notify when the datachannels open
+	pendingOpens atomic.Int32  // Number of datachannels yet to open
+	iceFailed    chan struct{} // Channel to notify when ICE fails
+	closed       chan struct{}
 
 	once sync.Once // Synchronization for PeerConnection destruction
 
 	bytesLogger  bytesLogger
 	eventsLogger event.SnowflakeEventReceiver
 	proxy        *url.URL
+
+	// snowflakeTimeout is how long the peer may go without receiving
+	// messages before it is considered stale and closed.
+	snowflakeTimeout time.Duration
+	// keepAliveInterval, if non-zero, is how long the peer may go without
+	// writing before it sends a keepalive message.
+	keepAliveInterval time.Duration
+	// iceGatheringTimeout is how long the peer waits for ICE candidate
+	// gathering to complete.
+	iceGatheringTimeout time.Duration
+	// onClosed, if set, is called once the peer is closed.
+	onClosed func(reason error)
+	// dataChannelOptions are used to create the data channel.
+	dataChannelOptions webrtc.DataChannelInit
+	// label is the label of the data channel.
+	label string
+	// dualDataChannels is whether the peer also has a bulk data channel.
+	dualDataChannels bool
+}
+
+// WebRTCPeerOptions holds the optional settings of a WebRTCPeer.
+type WebRTCPeerOptions struct {
+	// EventsLogger receives the peer's events. If nil, they are discarded.
+	EventsLogger event.SnowflakeEventReceiver
+	// Proxy, if set, is the proxy through which the peer connects.
+	Proxy *url.URL
+	// SnowflakeTimeout is how long the peer may go without receiving
+	// messages before it is closed. If zero, SnowflakeTimeout is used.
+	SnowflakeTimeout time.Duration
+	// KeepAliveInterval, if non-zero, makes the peer send a keepalive message
+	// whenever it has not written anything for that long.
+	KeepAliveInterval time.Duration
+	// ICEGatheringTimeout is how long the peer waits for ICE candidate
+	// gathering to complete, for example when a STUN server does not answer.
+	// If zero, ICEGatheringTimeout is used.
+	ICEGatheringTimeout time.Duration
+	// OnClosed, if set, is called exactly once when the peer closes, with
+	// ErrPeerStale, ErrPeerClosedRemotely or ErrPeerClosedLocally as the
+	// reason.
+	OnClosed func(reason error)
+	// Ordered, if set, is whether the data channel delivers messages in
+	// order. If nil, they are delivered in order.
+	Ordered *bool
+	// MaxRetransmits and MaxPacketLifeTime, if set, make the data channel
+	// partially reliable: a message is given up on after that many
+	// retransmissions, or after that many milliseconds. At most one of them
+	// may be set. If neither is, messages are delivered reliably.
+	MaxRetransmits    *uint16
+	MaxPacketLifeTime *uint16
+	// DataChannelLabel, if set, is the label of the data channel, which may
+	// be empty. If nil, the peer's identifier, "snowflake-" followed by
+	// random hex digits, is used.
+	DataChannelLabel *string
+	// DualDataChannels, if set, makes the peer open a second, unordered and
+	// unreliable, bulk data channel besides the control one, labeled with
+	// the control channel's label followed by "-bulk". This is
+	// experimental: proxies built from this tree read the bulk channel
+	// into the same relay connection, but older proxies panic on a second
+	// data channel, dropping the connection. Do not set it against proxies
+	// you do not control.
+	DualDataChannels bool
+}
+
+// WebRTCPeerStats is a snapshot of the state of a WebRTCPeer.
+type WebRTCPeerStats struct {
+	// ID is the peer's identifier, which is also its data channel label
+	// unless WebRTCPeerOptions.DataChannelLabel was set.
+	ID string
+	// InboundBytes and OutboundBytes are the total number of bytes received
+	// from and sent to the snowflake proxy.
+	InboundBytes, OutboundBytes int64
+	// LastReceive is the time at which a message was last received.
+	LastReceive time.Time
+	// DataChannelState is the state of the peer's data channel, or
+	// DataChannelStateUnknown if it has not been created.
+	DataChannelState webrtc.DataChannelState
 }
 
 // Deprecated: Use NewWebRTCPeerWithEventsAndProxy Instead.
@@ -69,9 +202,30 @@ func NewWebRTCPeerWithEventsAndProxy(
 	config *webrtc.Configuration, broker *BrokerChannel,
 	eventsLogger event.SnowflakeEventReceiver, proxy *url.URL,
 ) (*WebRTCPeer, error) {
+	return NewWebRTCPeerWithOptions(config, broker, WebRTCPeerOptions{
+		EventsLogger: eventsLogger,
+		Proxy:        proxy,
+	})
+}
+
+// NewWebRTCPeerWithOptions is like NewWebRTCPeerWithEventsAndProxy, with the
+// settings given in options.
+func NewWebRTCPeerWithOptions(
+	config *webrtc.Configuration, broker *BrokerChannel,
+	options WebRTCPeerOptions,
+) (*WebRTCPeer, error) {
+	eventsLogger := options.EventsLogger
 	if eventsLogger == nil {
 		eventsLogger = event.NewSnowflakeEventDispatcher()
 	}
+	snowflakeTimeout := options.SnowflakeTimeout
+	if snowflakeTimeout == 0 {
+		snowflakeTimeout = SnowflakeTimeout
+	}
+	iceGatheringTimeout := options.ICEGatheringTimeout
+	if iceGatheringTimeout == 0 {
+		iceGatheringTimeout = ICEGatheringTimeout
+	}
 
 	connection := new(WebRTCPeer)
 	{
@@ -81,6 +235,10 @@ func NewWebRTCPeerWithEventsAndProxy(
 		}
 		connection.id = "snowflake-" + hex.EncodeToString(buf[:])
 	}
+	connection.label = connection.id
+	if options.DataChannelLabel != nil {
+		connection.label = *options.DataChannelLabel
+	}
 	connection.closed = make(chan struct{})
 
 	// Override with something that's not NullLogger to have real logging.
@@ -90,7 +248,21 @@ func NewWebRTCPeerWithEventsAndProxy(
 	connection.recvPipe, connection.writePipe = io.Pipe()
 
 	connection.eventsLogger = eventsLogger
-	connection.proxy = proxy
+	connection.proxy = options.Proxy
+	connection.snowflakeTimeout = snowflakeTimeout
+	connection.keepAliveInterval = options.KeepAliveInterval
+	connection.iceGatheringTimeout = iceGatheringTimeout
+	connection.dualDataChannels = options.DualDataChannels
+	connection.onClosed = options.OnClosed
+	ordered := true
+	if options.Ordered != nil {
+		ordered = *options.Ordered
+	}
+	connection.dataChannelOptions = webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxRetransmits:    options.MaxRetransmits,
+		MaxPacketLifeTime: options.MaxPacketLifeTime,
+	}
 
 	err := connection.connect(config, broker)
 	if err != nil {
@@ -106,17 +278,68 @@ func (c *WebRTCPeer) Read(b []byte) (int, error) {
 	return c.recvPipe.Read(b)
 }
 
-// Writes bytes out to remote WebRTC.
+// Writes bytes out to remote WebRTC, on the data channel given by
+// WriteChannel.
 // As part of |io.ReadWriter|
 func (c *WebRTCPeer) Write(b []byte) (int, error) {
-	err := c.transport.Send(b)
+	dc := c.transport
+	if c.WriteChannel() == DataChannelBulk {
+		dc = c.bulk
+	}
+	err := dc.Send(b)
 	if err != nil {
 		return 0, err
 	}
 	c.bytesLogger.addOutbound(int64(len(b)))
+	c.mu.Lock()
+	c.outboundBytes += int64(len(b))
+	c.lastWrite = time.Now()
+	c.mu.Unlock()
 	return len(b), nil
 }
 
+// WriteChannel returns the data channel that Write sends on. It is
+// DataChannelControl unless changed with SetWriteChannel.
+func (c *WebRTCPeer) WriteChannel() DataChannelKind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeChannel
+}
+
+// SetWriteChannel sets the data channel that Write sends on. It returns an
+// error if the peer does not have that channel.
+func (c *WebRTCPeer) SetWriteChannel(kind DataChannelKind) error {
+	switch kind {
+	case DataChannelControl:
+	case DataChannelBulk:
+		if !c.dualDataChannels {
+			return errors.New("peer has no bulk data channel")
+		}
+	default:
+		return fmt.Errorf("unknown data channel %v", kind)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeChannel = kind
+	return nil
+}
+
+// Stats returns a snapshot of the peer's traffic and data channel state.
+func (c *WebRTCPeer) Stats() WebRTCPeerStats {
+	c.mu.Lock()
+	stats := WebRTCPeerStats{
+		ID:            c.id,
+		InboundBytes:  c.inboundBytes,
+		OutboundBytes: c.outboundBytes,
+		LastReceive:   c.lastReceive,
+	}
+	c.mu.Unlock()
+	if c.transport != nil {
+		stats.DataChannelState = c.transport.ReadyState()
+	}
+	return stats
+}
+
 // Closed returns a boolean indicated whether the peer is closed.
 func (c *WebRTCPeer) Closed() bool {
 	select {
@@ -129,12 +352,21 @@ func (c *WebRTCPeer) Closed() bool {
 
 // Close closes the connection the snowflake proxy.
 func (c *WebRTCPeer) Close() error {
+	c.closeWithReason(ErrPeerClosedLocally)
+	return nil
+}
+
+// closeWithReason closes the connection, passing reason to the OnClosed
+// callback if this is the first time it is closed.
+func (c *WebRTCPeer) closeWithReason(reason error) {
 	c.once.Do(func() {
 		close(c.closed)
 		c.cleanup()
 		log.Printf("WebRTC: Closing")
+		if c.onClosed != nil {
+			c.onClosed(reason)
+		}
 	})
-	return nil
 }
 
 // Prevent long-lived broken remotes.
@@ -151,9 +383,8 @@ func (c *WebRTCPeer) checkForStaleness(timeout time.Duration) {
 		if time.Since(lastReceive) > timeout {
 			log.Printf("WebRTC: No messages received for %v -- closing stale connection.",
 				timeout)
-			err := errors.New("no messages received, closing stale connection")
-			c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: err})
-			c.Close()
+			c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: ErrPeerStale})
+			c.closeWithReason(ErrPeerStale)
 			return
 		}
 		select {
@@ -164,6 +395,35 @@ func (c *WebRTCPeer) checkForStaleness(timeout time.Duration) {
 	}
 }
 
+// keepAlive sends a padding chunk, which the server discards, whenever nothing
+// has been written for interval, so that an idle connection is not closed for
+// inactivity by the proxy. It only starts once something has been written,
+// because the stream must begin with the turbotunnel token.
+func (c *WebRTCPeer) keepAlive(interval time.Duration) {
+	var padding bytes.Buffer
+	encapsulation.WritePadding(&padding, keepAlivePaddingSize)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		lastWrite := c.lastWrite
+		c.mu.Unlock()
+		if lastWrite.IsZero() || time.Since(lastWrite) < interval {
+			continue
+		}
+		if _, err := c.Write(padding.Bytes()); err != nil {
+			log.Printf("WebRTC: error sending keepalive: %v", err)
+			return
+		}
+	}
+}
+
 // connect does the bulk of the work: gather ICE candidates, send the SDP offer to broker,
 // receive an answer from broker, and wait for data channel to open
 func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel) error {
@@ -194,9 +454,16 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 		return err
 	}
 
-	// Wait for the datachannel to open or time out
+	// Wait for the datachannel to open, ICE to fail, or time out. Returning
+	// as soon as ICE fails lets the caller retry with a new peer instead of
+	// waiting for the timeout.
 	select {
 	case <-c.open:
+	case <-c.iceFailed:
+		c.transport.Close()
+		err = ErrICEFailed
+		c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: err})
+		return err
 	case <-time.After(DataChannelTimeout):
 		c.transport.Close()
 		err = errors.New("timeout waiting for DataChannel.OnOpen")
@@ -204,7 +471,10 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 		return err
 	}
 
-	go c.checkForStaleness(SnowflakeTimeout)
+	go c.checkForStaleness(c.snowflakeTimeout)
+	if c.keepAliveInterval > 0 {
+		go c.keepAlive(c.keepAliveInterval)
+	}
 	return nil
 }
 
@@ -251,49 +521,39 @@ func (c *WebRTCPeer) preparePeerConnection(
 		log.Printf("NewPeerConnection ERROR: %s", err)
 		return err
 	}
-	ordered := true
-	dataChannelOptions := &webrtc.DataChannelInit{
-		Ordered: &ordered,
+	c.iceFailed = make(chan struct{}, 1)
+	c.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateFailed {
+			log.Println("WebRTC: ICE connection failed")
+			select {
+			case c.iceFailed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	c.open = make(chan struct{})
+	c.pendingOpens.Store(1)
+	if c.dualDataChannels {
+		c.pendingOpens.Store(2)
 	}
-	// We must create the data channel before creating an offer
+	// We must create the data channels before creating an offer
 	// https://github.com/pion/webrtc/wiki/Release-WebRTC@v3.0.0#a-data-channel-is-no-longer-implicitly-created-with-a-peerconnection
-	dc, err := c.pc.CreateDataChannel(c.id, dataChannelOptions)
+	dataChannelOptions := c.dataChannelOptions
+	c.transport, err = c.createDataChannel(c.label, &dataChannelOptions)
 	if err != nil {
-		log.Printf("CreateDataChannel ERROR: %s", err)
 		return err
 	}
-	dc.OnOpen(func() {
-		c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
-		log.Println("WebRTC: DataChannel.OnOpen")
-		close(c.open)
-	})
-	dc.OnClose(func() {
-		log.Println("WebRTC: DataChannel.OnClose")
-		c.Close()
-	})
-	dc.OnError(func(err error) {
-		c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: err})
-	})
-	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if len(msg.Data) <= 0 {
-			log.Println("0 length message---")
-		}
-		n, err := c.writePipe.Write(msg.Data)
-		c.bytesLogger.addInbound(int64(n))
+	if c.dualDataChannels {
+		ordered := false
+		maxRetransmits := uint16(0)
+		c.bulk, err = c.createDataChannel(c.label+"-bulk", &webrtc.DataChannelInit{
+			Ordered:        &ordered,
+			MaxRetransmits: &maxRetransmits,
+		})
 		if err != nil {
-			// TODO: Maybe shouldn't actually close.
-			log.Println("Error writing to SOCKS pipe")
-			if inerr := c.writePipe.CloseWithError(err); inerr != nil {
-				log.Printf("c.writePipe.CloseWithError returned error: %v", inerr)
-			}
+			return err
 		}
-		c.mu.Lock()
-		c.lastReceive = time.Now()
-		c.mu.Unlock()
-	})
-	c.transport = dc
-	c.open = make(chan struct{})
-	log.Println("WebRTC: DataChannel created")
+	}
 
 	offer, err := c.pc.CreateOffer(nil)
 	// TODO: Potentially timeout and retry if ICE isn't working.
@@ -315,11 +575,63 @@ func (c *WebRTCPeer) preparePeerConnection(
 	}
 	log.Println("WebRTC: Set local description")
 
-	<-done // Wait for ICE candidate gathering to complete.
+	// Wait for ICE candidate gathering to complete or time out.
+	select {
+	case <-done:
+	case <-time.After(c.iceGatheringTimeout):
+		log.Println("WebRTC: ICE candidate gathering timed out")
+		c.pc.Close()
+		return ErrICEGatheringTimeout
+	}
 
 	return nil
 }
 
+// createDataChannel creates a data channel whose messages are passed on to
+// Read, and that closes the peer when it closes. c.open is closed once all
+// the data channels are open.
+func (c *WebRTCPeer) createDataChannel(label string, options *webrtc.DataChannelInit) (*webrtc.DataChannel, error) {
+	dc, err := c.pc.CreateDataChannel(label, options)
+	if err != nil {
+		log.Printf("CreateDataChannel ERROR: %s", err)
+		return nil, err
+	}
+	dc.OnOpen(func() {
+		log.Println("WebRTC: DataChannel.OnOpen", label)
+		if c.pendingOpens.Add(-1) == 0 {
+			c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnected{})
+			close(c.open)
+		}
+	})
+	dc.OnClose(func() {
+		log.Println("WebRTC: DataChannel.OnClose", label)
+		c.closeWithReason(ErrPeerClosedRemotely)
+	})
+	dc.OnError(func(err error) {
+		c.eventsLogger.OnNewSnowflakeEvent(event.EventOnSnowflakeConnectionFailed{Error: err})
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) <= 0 {
+			log.Println("0 length message---")
+		}
+		n, err := c.writePipe.Write(msg.Data)
+		c.bytesLogger.addInbound(int64(n))
+		if err != nil {
+			// TODO: Maybe shouldn't actually close.
+			log.Println("Error writing to SOCKS pipe")
+			if inerr := c.writePipe.CloseWithError(err); inerr != nil {
+				log.Printf("c.writePipe.CloseWithError returned error: %v", inerr)
+			}
+		}
+		c.mu.Lock()
+		c.lastReceive = time.Now()
+		c.inboundBytes += int64(n)
+		c.mu.Unlock()
+	})
+	log.Println("WebRTC: DataChannel created", label)
+	return dc, nil
+}
+
 // cleanup closes all channels and transports
 func (c *WebRTCPeer) cleanup() {
 	// Close this side of the SOCKS pipe.
@@ -330,6 +642,10 @@ func (c *WebRTCPeer) cleanup() {
 		log.Printf("WebRTC: closing DataChannel")
 		c.transport.Close()
 	}
+	if nil != c.bulk {
+		log.Printf("WebRTC: closing bulk DataChannel")
+		c.bulk.Close()
+	}
 	if nil != c.pc {
 		log.Printf("WebRTC: closing PeerConnection")
 		err := c.pc.Close()
@@ -2,6 +2,7 @@ package event
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/pion/webrtc/v4"
@@ -75,22 +76,191 @@ func (e EventOnProxyClientConnected) String() string {
 	return fmt.Sprintf("client connected")
 }
 
+type EventOnProxyCandidatePairSelected struct {
+	SnowflakeEvent
+	LocalCandidateType  webrtc.ICECandidateType
+	LocalAddress        string
+	RemoteCandidateType webrtc.ICECandidateType
+	RemoteAddress       string
+}
+
+func (e EventOnProxyCandidatePairSelected) String() string {
+	return fmt.Sprintf("selected candidate pair: local %v, remote %v",
+		e.LocalCandidateType, e.RemoteCandidateType)
+}
+
+type EventOnProxyConnectionRejected struct {
+	SnowflakeEvent
+	RemoteAddr net.Addr
+}
+
+func (e EventOnProxyConnectionRejected) String() string {
+	return "Proxy connection rejected"
+}
+
+type EventOnProxyOfferRejected struct {
+	SnowflakeEvent
+	SessionID string
+	// Reason is why the client offer from the broker was rejected.
+	Reason string
+}
+
+func (e EventOnProxyOfferRejected) String() string {
+	return fmt.Sprintf("rejected offer from broker: %s", e.Reason)
+}
+
+type EventOnProxyRelayRejected struct {
+	SnowflakeEvent
+	SessionID string
+	// RelayURL is the relay URL supplied by the broker.
+	RelayURL string
+	// Reason is why the relay URL was rejected, for example because it
+	// does not match the allowed hostname pattern, or is not TLS.
+	Reason string
+}
+
+func (e EventOnProxyRelayRejected) String() string {
+	return fmt.Sprintf("rejected relay URL from broker: %s", e.Reason)
+}
+
+type EventOnProxyConnectionStarted struct {
+	SnowflakeEvent
+	// ConnectionID identifies the connection. The EventOnProxyConnectionOver
+	// sent when it ends carries the same ID.
+	ConnectionID  string
+	ClientNATType string
+}
+
+func (e EventOnProxyConnectionStarted) String() string {
+	return "Proxy connection started"
+}
+
 type EventOnProxyConnectionOver struct {
 	SnowflakeEvent
-	InboundTraffic  int64
-	OutboundTraffic int64
+	ConnectionID string
+	// Deprecated: use InboundBytes and OutboundBytes, which they are
+	// equal to.
+	InboundTraffic, OutboundTraffic int64
+	// InboundBytes and OutboundBytes are the number of bytes relayed
+	// over this connection only, in each direction.
+	InboundBytes, OutboundBytes int64
+	// TrafficRatio is how many times more bytes went in the busier
+	// direction than in the other one, or 0 if there was no traffic.
+	TrafficRatio float64
 }
 
 func (e EventOnProxyConnectionOver) String() string {
 	return fmt.Sprintf("Proxy connection closed")
 }
 
+type EventOnICEGatheringComplete struct {
+	SnowflakeEvent
+	SessionID string
+	Duration  time.Duration
+	// TimedOut is set if the answer was sent before gathering completed.
+	// Proxies that trickle ICE always send the answer early, and only
+	// dispatch the event once gathering has completed, without TimedOut.
+	TimedOut bool
+	// ServerReflexive is set if at least one server reflexive candidate
+	// was gathered.
+	ServerReflexive bool
+}
+
+func (e EventOnICEGatheringComplete) String() string {
+	if e.TimedOut {
+		return fmt.Sprintf("ICE gathering timed out after %v", e.Duration)
+	}
+	return fmt.Sprintf("ICE gathering completed in %v", e.Duration)
+}
+
+type EventOnProxyICEConnectionStateChange struct {
+	SnowflakeEvent
+	SessionID string
+	State     webrtc.ICEConnectionState
+}
+
+func (e EventOnProxyICEConnectionStateChange) String() string {
+	return fmt.Sprintf("ICE connection state changed to %v", e.State)
+}
+
+type EventOnProxyPeerConnectionStateChange struct {
+	SnowflakeEvent
+	SessionID string
+	State     webrtc.PeerConnectionState
+}
+
+func (e EventOnProxyPeerConnectionStateChange) String() string {
+	return fmt.Sprintf("peer connection state changed to %v", e.State)
+}
+
+type EventOnProxyPollFailed struct {
+	SnowflakeEvent
+	Error error
+}
+
+func (e EventOnProxyPollFailed) String() string {
+	scrubbed := safelog.Scrub([]byte(e.Error.Error()))
+	return fmt.Sprintf("broker poll failure %s", scrubbed)
+}
+
+type EventOnProxyPollSucceeded struct {
+	SnowflakeEvent
+}
+
+func (e EventOnProxyPollSucceeded) String() string {
+	return "broker poll succeeded"
+}
+
+type EventOnProxyPollResponse struct {
+	SnowflakeEvent
+	// MatchedOffer is set if the broker returned a client offer.
+	MatchedOffer bool
+	PollDuration time.Duration
+	// Error is the reason the poll failed, or empty if it succeeded.
+	Error string
+}
+
+func (e EventOnProxyPollResponse) String() string {
+	if e.Error != "" {
+		scrubbed := safelog.Scrub([]byte(e.Error))
+		return fmt.Sprintf("broker poll failed after %v: %s", e.PollDuration, scrubbed)
+	}
+	if e.MatchedOffer {
+		return fmt.Sprintf("broker poll matched a client in %v", e.PollDuration)
+	}
+	return fmt.Sprintf("broker poll matched no client in %v", e.PollDuration)
+}
+
+type EventOnProxyAtCapacity struct {
+	SnowflakeEvent
+	Capacity uint
+	Time     time.Time
+}
+
+func (e EventOnProxyAtCapacity) String() string {
+	return fmt.Sprintf("proxy at capacity of %d clients", e.Capacity)
+}
+
+type EventOnProxyBelowCapacity struct {
+	SnowflakeEvent
+	Capacity uint
+	Time     time.Time
+}
+
+func (e EventOnProxyBelowCapacity) String() string {
+	return fmt.Sprintf("proxy below capacity of %d clients", e.Capacity)
+}
+
 type EventOnProxyStats struct {
 	SnowflakeEvent
 	ConnectionCount             int
 	InboundBytes, OutboundBytes int64
 	InboundUnit, OutboundUnit   string
 	SummaryInterval             time.Duration
+	// Uptime is the time since the proxy started, and NATType its current
+	// NAT type.
+	Uptime  time.Duration
+	NATType string
 }
 
 func (e EventOnProxyStats) String() string {
@@ -98,18 +268,43 @@ func (e EventOnProxyStats) String() string {
 		e.SummaryInterval.String(), e.ConnectionCount,
 		e.InboundBytes, e.InboundUnit, float64(e.InboundBytes)/e.SummaryInterval.Seconds(), e.InboundUnit, "/s",
 		e.OutboundBytes, e.OutboundUnit, float64(e.OutboundBytes)/e.SummaryInterval.Seconds(), e.OutboundUnit, "/s")
+	if e.NATType != "" {
+		statString += fmt.Sprintf(" Uptime %v, NAT type %v.", e.Uptime.Round(time.Second), e.NATType)
+	}
 	return statString
 }
 
 type EventOnCurrentNATTypeDetermined struct {
 	SnowflakeEvent
 	CurNATType string
+	// PreviousNATType is the NAT type before this determination.
+	PreviousNATType string
 }
 
 func (e EventOnCurrentNATTypeDetermined) String() string {
+	if e.PreviousNATType != "" && e.PreviousNATType != e.CurNATType {
+		return fmt.Sprintf("NAT type: %v -> %v", e.PreviousNATType, e.CurNATType)
+	}
 	return fmt.Sprintf("NAT type: %v", e.CurNATType)
 }
 
+type EventOnNATProbeCompleted struct {
+	SnowflakeEvent
+	Duration time.Duration
+	// NATType is the NAT type the probe determined, if it succeeded.
+	NATType string
+	// Error is the reason the probe failed, or empty if it succeeded.
+	Error string
+}
+
+func (e EventOnNATProbeCompleted) String() string {
+	if e.Error != "" {
+		scrubbed := safelog.Scrub([]byte(e.Error))
+		return fmt.Sprintf("NAT probe failed after %v: %s", e.Duration, scrubbed)
+	}
+	return fmt.Sprintf("NAT probe found NAT type %v in %v", e.NATType, e.Duration)
+}
+
 type SnowflakeEventReceiver interface {
 	// OnNewSnowflakeEvent notify receiver about a new event
 	// This method MUST not block
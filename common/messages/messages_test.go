@@ -131,6 +131,27 @@ func TestEncodeProxyPollRequests(t *testing.T) {
 		So(clients, ShouldEqual, 16)
 		So(err, ShouldBeNil)
 	})
+	Convey("Bandwidth class", t, func() {
+		b, err := EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", "unknown", 16, "snowflake.torproject.net")
+		So(err, ShouldBeNil)
+		So(string(b), ShouldNotContainSubstring, "BandwidthClass")
+
+		b, err = EncodeProxyPollRequestWithBandwidthClass("ymbcCMto7KHNGYlp", "standalone", "unknown", 16, "snowflake.torproject.net", "high")
+		So(err, ShouldBeNil)
+		var message ProxyPollRequest
+		So(json.Unmarshal(b, &message), ShouldBeNil)
+		So(message.BandwidthClass, ShouldEqual, "high")
+
+		// Brokers that do not know about the bandwidth class still
+		// decode the request.
+		sid, proxyType, natType, clients, relayPattern, _, err := DecodeProxyPollRequestWithRelayPrefix(b)
+		So(err, ShouldBeNil)
+		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(proxyType, ShouldEqual, "standalone")
+		So(natType, ShouldEqual, "unknown")
+		So(clients, ShouldEqual, 16)
+		So(relayPattern, ShouldEqual, "snowflake.torproject.net")
+	})
 }
 
 func TestDecodeProxyPollResponse(t *testing.T) {
@@ -275,6 +296,58 @@ func TestEncodeProxyAnswerRequest(t *testing.T) {
 	})
 }
 
+func TestDecodeProxyCandidateRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		for _, test := range []struct {
+			candidate string
+			sid       string
+			data      string
+			err       error
+		}{
+			{
+				"candidate:1 1 udp 2130706431 192.0.2.1 9 typ host",
+				"test",
+				`{"Version":"1.3","Sid":"test","Candidate":"candidate:1 1 udp 2130706431 192.0.2.1 9 typ host"}`,
+				nil,
+			},
+			{
+				"",
+				"",
+				`{"Version":"2.0","Sid":"test","Candidate":"test"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				"",
+				`{"Version":"1.3","Candidate":"test"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				"",
+				`{"Version":"1.3","Sid":"test"}`,
+				fmt.Errorf(""),
+			},
+		} {
+			candidate, sid, err := DecodeCandidateRequest([]byte(test.data))
+			So(candidate, ShouldResemble, test.candidate)
+			So(sid, ShouldResemble, test.sid)
+			So(err, ShouldHaveSameTypeAs, test.err)
+		}
+	})
+}
+
+func TestEncodeProxyCandidateRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeCandidateRequest("test candidate", "test sid")
+		So(err, ShouldBeNil)
+		candidate, sid, err := DecodeCandidateRequest(b)
+		So(candidate, ShouldEqual, "test candidate")
+		So(sid, ShouldEqual, "test sid")
+		So(err, ShouldBeNil)
+	})
+}
+
 func TestDecodeProxyAnswerResponse(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
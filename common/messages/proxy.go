@@ -33,9 +33,18 @@ var KnownProxyTypes = map[string]bool{
   Type: ["badge"|"webext"|"standalone"],
   NAT: ["unknown"|"restricted"|"unrestricted"],
   Clients: [number of current clients, rounded down to multiples of 8],
-  AcceptedRelayPattern: [a pattern representing accepted set of relay domains]
+  AcceptedRelayPattern: [a pattern representing accepted set of relay domains],
+  BandwidthClass: [optional bandwidth class advertised by the proxy, e.g. "high"],
+  AcceptedClientNATTypes: [optional list of client NAT types the proxy serves]
 }
 
+BandwidthClass is omitted when the proxy does not advertise one. Brokers may
+use it as a hint when matching clients, or ignore it.
+
+AcceptedClientNATTypes is omitted when the proxy serves clients of any NAT
+type. Brokers should not match the proxy with clients of other NAT types;
+proxies drop such offers.
+
 == ProxyPollResponse ==
 1) If a client is matched:
 HTTP 200 OK
@@ -88,6 +97,18 @@ HTTP 200 OK
 3) If the request is malformed:
 HTTP 400 BadRequest
 
+== ProxyCandidateRequest ==
+For proxies that trickle ICE, for each candidate gathered after the answer.
+Reserved: the broker does not handle it yet, and proxies do not send it.
+{
+  Sid: [generated session id of proxy],
+  Version: 1.3,
+  Candidate: [ICE candidate attribute, e.g. "candidate:1 1 udp 2130706431 ..."]
+}
+
+== ProxyCandidateResponse ==
+The same as ProxyAnswerResponse.
+
 */
 
 type ProxyPollRequest struct {
@@ -98,6 +119,10 @@ type ProxyPollRequest struct {
 	Clients int
 
 	AcceptedRelayPattern *string
+	BandwidthClass       string `json:",omitempty"`
+	// AcceptedClientNATTypes, if not empty, lists the client NAT types the
+	// proxy will serve.
+	AcceptedClientNATTypes []string `json:",omitempty"`
 }
 
 func EncodeProxyPollRequest(sid string, proxyType string, natType string, clients int) ([]byte, error) {
@@ -105,13 +130,30 @@ func EncodeProxyPollRequest(sid string, proxyType string, natType string, client
 }
 
 func EncodeProxyPollRequestWithRelayPrefix(sid string, proxyType string, natType string, clients int, relayPattern string) ([]byte, error) {
+	return EncodeProxyPollRequestWithBandwidthClass(sid, proxyType, natType, clients, relayPattern, "")
+}
+
+// EncodeProxyPollRequestWithBandwidthClass is like
+// EncodeProxyPollRequestWithRelayPrefix, but also advertises the proxy's
+// bandwidth class. An empty bandwidthClass is left out of the request.
+func EncodeProxyPollRequestWithBandwidthClass(sid string, proxyType string, natType string, clients int, relayPattern string, bandwidthClass string) ([]byte, error) {
+	return EncodeProxyPollRequestWithClientNATTypes(sid, proxyType, natType, clients, relayPattern, bandwidthClass, nil)
+}
+
+// EncodeProxyPollRequestWithClientNATTypes is like
+// EncodeProxyPollRequestWithBandwidthClass, but also tells the broker which
+// client NAT types the proxy will serve. An empty clientNATTypes, meaning all
+// of them, is left out of the request.
+func EncodeProxyPollRequestWithClientNATTypes(sid string, proxyType string, natType string, clients int, relayPattern string, bandwidthClass string, clientNATTypes []string) ([]byte, error) {
 	return json.Marshal(ProxyPollRequest{
-		Sid:                  sid,
-		Version:              version,
-		Type:                 proxyType,
-		NAT:                  natType,
-		Clients:              clients,
-		AcceptedRelayPattern: &relayPattern,
+		Sid:                    sid,
+		Version:                version,
+		Type:                   proxyType,
+		NAT:                    natType,
+		Clients:                clients,
+		AcceptedRelayPattern:   &relayPattern,
+		BandwidthClass:         bandwidthClass,
+		AcceptedClientNATTypes: clientNATTypes,
 	})
 }
 
@@ -274,6 +316,41 @@ func DecodeAnswerRequest(data []byte) (string, string, error) {
 	return message.Answer, message.Sid, nil
 }
 
+type ProxyCandidateRequest struct {
+	Version   string
+	Sid       string
+	Candidate string
+}
+
+func EncodeCandidateRequest(candidate string, sid string) ([]byte, error) {
+	return json.Marshal(ProxyCandidateRequest{
+		Version:   version,
+		Sid:       sid,
+		Candidate: candidate,
+	})
+}
+
+// Returns the ICE candidate and proxy sid
+func DecodeCandidateRequest(data []byte) (string, string, error) {
+	var message ProxyCandidateRequest
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return "", "", err
+	}
+
+	majorVersion := strings.Split(message.Version, ".")[0]
+	if majorVersion != "1" {
+		return "", "", fmt.Errorf("using unknown version")
+	}
+
+	if message.Sid == "" || message.Candidate == "" {
+		return "", "", fmt.Errorf("no supplied sid or candidate")
+	}
+
+	return message.Candidate, message.Sid, nil
+}
+
 type ProxyAnswerResponse struct {
 	Status string
 }
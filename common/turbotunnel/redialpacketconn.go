@@ -9,6 +9,16 @@ import (
 	"time"
 )
 
+// Directions passed to a RedialPacketConn's drop hook.
+const (
+	// DropSend means that an outgoing packet was dropped because the send
+	// queue was full.
+	DropSend = "send"
+	// DropRecv means that an incoming packet was dropped because the
+	// receive queue was full.
+	DropRecv = "recv"
+)
+
 // RedialPacketConn implements a long-lived net.PacketConn atop a sequence of
 // other, transient net.PacketConns. RedialPacketConn creates a new
 // net.PacketConn by calling a provided dialContext function. Whenever the
@@ -18,12 +28,12 @@ import (
 // methods return an error only when the dialContext function returns an error.
 //
 // RedialPacketConn uses static local and remote addresses that are independent
-// of those of any dialed net.PacketConn.
+// of those of any dialed net.PacketConn, unless SetPreserveSourceAddr is used.
 type RedialPacketConn struct {
 	localAddr   net.Addr
 	remoteAddr  net.Addr
 	dialContext func(context.Context) (net.PacketConn, error)
-	recvQueue   chan []byte
+	recvQueue   chan taggedPacket
 	sendQueue   chan []byte
 	closed      chan struct{}
 	closeOnce   sync.Once
@@ -31,6 +41,10 @@ type RedialPacketConn struct {
 	// closed and is returned from future read/write operations. Compare to
 	// the rerr and werr in io.Pipe.
 	err atomic.Value
+	// dropHook holds the func(direction string) set by SetDropHook.
+	dropHook atomic.Value
+	// preserveSourceAddr is set by SetPreserveSourceAddr.
+	preserveSourceAddr atomic.Bool
 }
 
 // NewRedialPacketConn makes a new RedialPacketConn, with the given static local
@@ -43,7 +57,7 @@ func NewRedialPacketConn(
 		localAddr:   localAddr,
 		remoteAddr:  remoteAddr,
 		dialContext: dialContext,
-		recvQueue:   make(chan []byte, queueSize),
+		recvQueue:   make(chan taggedPacket, queueSize),
 		sendQueue:   make(chan []byte, queueSize),
 		closed:      make(chan struct{}),
 		err:         atomic.Value{},
@@ -94,7 +108,7 @@ func (c *RedialPacketConn) exchange(conn net.PacketConn) {
 			}
 
 			var buf [1500]byte
-			n, _, err := conn.ReadFrom(buf[:])
+			n, addr, err := conn.ReadFrom(buf[:])
 			if err != nil {
 				readErrCh <- err
 				return
@@ -102,8 +116,9 @@ func (c *RedialPacketConn) exchange(conn net.PacketConn) {
 			p := make([]byte, n)
 			copy(p, buf[:])
 			select {
-			case c.recvQueue <- p:
+			case c.recvQueue <- taggedPacket{p, addr}:
 			default: // OK to drop packets.
+				c.dropped(DropRecv)
 			}
 		}
 	}()
@@ -134,7 +149,7 @@ func (c *RedialPacketConn) exchange(conn net.PacketConn) {
 
 // ReadFrom reads a packet from the currently active net.PacketConn. The
 // packet's original remote address is replaced with the RedialPacketConn's own
-// remote address.
+// remote address, unless SetPreserveSourceAddr(true) was called.
 func (c *RedialPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	select {
 	case <-c.closed:
@@ -144,8 +159,12 @@ func (c *RedialPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	select {
 	case <-c.closed:
 		return 0, nil, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.remoteAddr, Err: c.err.Load().(error)}
-	case buf := <-c.recvQueue:
-		return copy(p, buf), c.remoteAddr, nil
+	case packet := <-c.recvQueue:
+		addr := c.remoteAddr
+		if c.preserveSourceAddr.Load() && packet.Addr != nil {
+			addr = packet.Addr
+		}
+		return copy(p, packet.P), addr, nil
 	}
 }
 
@@ -166,10 +185,63 @@ func (c *RedialPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		return len(buf), nil
 	default:
 		// Drop the outgoing packet if the send queue is full.
+		c.dropped(DropSend)
 		return len(buf), nil
 	}
 }
 
+// flushPollInterval is how often Flush checks whether the send queue is empty.
+const flushPollInterval = 10 * time.Millisecond
+
+// Flush blocks until every packet queued by WriteTo has been taken from the
+// send queue to be written to the currently active net.PacketConn, or until
+// ctx is done, in which case it returns ctx.Err(). It returns an error if c is
+// closed before the send queue empties. Flush does not prevent concurrent
+// WriteTo calls from queueing more packets.
+func (c *RedialPacketConn) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return &net.OpError{Op: "flush", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.remoteAddr, Err: c.err.Load().(error)}
+		default:
+		}
+		if len(c.sendQueue) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetDropHook sets a function to be called, with DropSend or DropRecv, every
+// time a packet is dropped because a queue is full. By default drops are not
+// reported.
+func (c *RedialPacketConn) SetDropHook(hook func(direction string)) {
+	c.dropHook.Store(hook)
+}
+
+// SetPreserveSourceAddr sets whether ReadFrom returns the address that the
+// dialed net.PacketConn reported a packet as coming from, for example to tell
+// which transient connection delivered it, instead of the RedialPacketConn's
+// own remote address. It is disabled by default, because callers such as KCP
+// expect every packet to come from the same address.
+func (c *RedialPacketConn) SetPreserveSourceAddr(preserve bool) {
+	c.preserveSourceAddr.Store(preserve)
+}
+
+// dropped reports a packet dropped in the given direction to the drop hook.
+func (c *RedialPacketConn) dropped(direction string) {
+	if hook, _ := c.dropHook.Load().(func(string)); hook != nil {
+		hook(direction)
+	}
+}
+
 // closeWithError unblocks pending operations and makes future operations fail
 // with the given error. If err is nil, it becomes errClosedPacketConn.
 func (c *RedialPacketConn) closeWithError(err error) error {
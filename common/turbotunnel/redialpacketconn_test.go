@@ -0,0 +1,126 @@
+package turbotunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingPacketConn is a net.PacketConn whose WriteTo blocks until unblock is
+// closed.
+type blockingPacketConn struct {
+	DiscardPacketConn
+	unblock chan struct{}
+}
+
+func (c blockingPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	<-c.unblock
+	return len(p), nil
+}
+
+func TestRedialPacketConnFlush(t *testing.T) {
+	unblock := make(chan struct{})
+	conn := NewRedialPacketConn(emptyAddr{}, emptyAddr{}, func(context.Context) (net.PacketConn, error) {
+		return blockingPacketConn{unblock: unblock}, nil
+	})
+	defer conn.Close()
+
+	// An empty send queue flushes right away.
+	if err := conn.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush of empty queue returned %v", err)
+	}
+
+	// The first packet blocks the writer, so the rest stay queued.
+	for i := 0; i < 10; i++ {
+		conn.WriteTo([]byte("hello"), emptyAddr{})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := conn.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Flush of blocked queue returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	close(unblock)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Flush(ctx); err != nil {
+		t.Fatalf("Flush after unblocking returned %v", err)
+	}
+
+	conn.Close()
+	if err := conn.Flush(context.Background()); err == nil {
+		t.Fatalf("Flush of closed conn returned nil")
+	}
+}
+
+func TestRedialPacketConnDropHook(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	conn := NewRedialPacketConn(emptyAddr{}, emptyAddr{}, func(context.Context) (net.PacketConn, error) {
+		return blockingPacketConn{unblock: unblock}, nil
+	})
+	defer conn.Close()
+
+	drops := make(chan string, 10)
+	conn.SetDropHook(func(direction string) { drops <- direction })
+
+	// Overfill the send queue. One packet may be held by the blocked
+	// writer, so at least one is dropped.
+	for i := 0; i < queueSize+2; i++ {
+		conn.WriteTo([]byte("hello"), emptyAddr{})
+	}
+	select {
+	case direction := <-drops:
+		if direction != DropSend {
+			t.Errorf("got drop direction %q, expected %q", direction, DropSend)
+		}
+	default:
+		t.Errorf("no drop reported")
+	}
+}
+
+// onePacketConn is a net.PacketConn whose ReadFrom returns a single packet
+// from addr, then blocks forever.
+type onePacketConn struct {
+	DiscardPacketConn
+	addr net.Addr
+	sent chan struct{}
+}
+
+func (c onePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.sent:
+		select {}
+	default:
+		close(c.sent)
+		return copy(p, "hello"), c.addr, nil
+	}
+}
+
+func TestRedialPacketConnPreserveSourceAddr(t *testing.T) {
+	peerAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	for _, preserve := range []bool{false, true} {
+		conn := NewRedialPacketConn(emptyAddr{}, emptyAddr{}, func(context.Context) (net.PacketConn, error) {
+			return onePacketConn{addr: peerAddr, sent: make(chan struct{})}, nil
+		})
+		conn.SetPreserveSourceAddr(preserve)
+		var buf [10]byte
+		n, addr, err := conn.ReadFrom(buf[:])
+		conn.Close()
+		if err != nil {
+			t.Fatalf("ReadFrom returned %v", err)
+		}
+		if string(buf[:n]) != "hello" {
+			t.Errorf("got packet %q, expected %q", buf[:n], "hello")
+		}
+		expected := net.Addr(emptyAddr{})
+		if preserve {
+			expected = peerAddr
+		}
+		if addr != expected {
+			t.Errorf("with preserve %v, got address %v, expected %v", preserve, addr, expected)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package snowflake_proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPollRetryAfter bounds the delay that a broker can ask for before the next
+// poll, so that a broken Retry-After header cannot stop a proxy for good.
+const maxPollRetryAfter = 6 * time.Hour
+
+// pollBackoff returns how long to wait before polling the broker again, after
+// the given number of consecutive failed polls. The wait doubles with every
+// failure, starting from base and capped at max, and is randomized so that
+// proxies don't all return to the broker at the same time.
+func pollBackoff(base, max time.Duration, failures int) time.Duration {
+	if failures == 0 || max <= base {
+		return base
+	}
+	backoff := base
+	for i := 0; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// Pick a random duration in [backoff/2, backoff], but no less than base.
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if backoff < base {
+		backoff = base
+	}
+	return backoff
+}
+
+// nextPollDelay returns how long to wait before polling the broker again, after
+// the given number of consecutive failed polls: the backoff from pollBackoff,
+// or retryAfter, the delay the broker asked for when it rate limited the last
+// poll, whichever is longer. retryAfter is not capped at max, only at
+// maxPollRetryAfter.
+func nextPollDelay(base, max time.Duration, failures int, retryAfter time.Duration) time.Duration {
+	backoff := pollBackoff(base, max, failures)
+	if retryAfter = min(retryAfter, maxPollRetryAfter); retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+// parseRetryAfter returns the delay requested by the value of a Retry-After
+// header, which is either a number of seconds or an HTTP date, relative to
+// now. It returns zero if the value is empty, invalid or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
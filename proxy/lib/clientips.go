@@ -0,0 +1,128 @@
+package snowflake_proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// ipConnections counts the active client connections from each IP address.
+// The zero value counts no connections.
+type ipConnections struct {
+	lock   sync.Mutex
+	counts map[string]uint
+}
+
+// add counts a new connection from ip. It returns false, without counting the
+// connection, if there are already max connections from ip.
+func (c *ipConnections) add(ip string, max uint) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts[ip] >= max {
+		return false
+	}
+	if c.counts == nil {
+		c.counts = make(map[string]uint)
+	}
+	c.counts[ip]++
+	return true
+}
+
+// remove stops counting a connection from ip.
+func (c *ipConnections) remove(ip string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts[ip] <= 1 {
+		delete(c.counts, ip)
+		return
+	}
+	c.counts[ip]--
+}
+
+// clientIP returns the IP address of addr, or an empty string if addr is nil
+// or has no IP address.
+func clientIP(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// ClientIPMode controls how a client's IP address is passed to the relay.
+type ClientIPMode string
+
+const (
+	// ClientIPFull passes the client's full address.
+	ClientIPFull ClientIPMode = "full"
+	// ClientIPTruncated passes only the client's network: the first 24 bits
+	// of an IPv4 address, or the first 48 bits of an IPv6 address.
+	ClientIPTruncated ClientIPMode = "truncated"
+	// ClientIPNone does not pass the client's address at all.
+	ClientIPNone ClientIPMode = "none"
+)
+
+// valid reports whether m is a known ClientIPMode. The empty mode is
+// ClientIPFull.
+func (m ClientIPMode) valid() bool {
+	switch m {
+	case "", ClientIPFull, ClientIPTruncated, ClientIPNone:
+		return true
+	}
+	return false
+}
+
+// relayClientIP returns the client_ip value to pass to the relay for a client
+// at addr, according to mode, or an empty string if none should be passed.
+func relayClientIP(addr net.Addr, mode ClientIPMode) string {
+	if addr == nil {
+		return ""
+	}
+	if mode == ClientIPNone {
+		return ""
+	}
+	ip := net.ParseIP(normalizeClientIP(addr))
+	if ip == nil {
+		return ""
+	}
+	if mode == ClientIPTruncated {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return ip.String()
+}
+
+// normalizeClientIP returns the IP address of addr as a plain IP literal,
+// without a port, brackets or IPv6 zone, which is what the relay expects in
+// client_ip. It returns an empty string if addr has no IP address.
+func normalizeClientIP(addr net.Addr) string {
+	if ip := clientIP(addr); ip != "" {
+		return ip
+	}
+	if addr == nil {
+		return ""
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
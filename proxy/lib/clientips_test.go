@@ -0,0 +1,69 @@
+package snowflake_proxy
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIPConnections(t *testing.T) {
+	Convey("Connections per IP", t, func() {
+		var c ipConnections
+		So(c.add("1.2.3.4", 2), ShouldBeTrue)
+		So(c.add("1.2.3.4", 2), ShouldBeTrue)
+		So(c.add("1.2.3.4", 2), ShouldBeFalse)
+		So(c.add("5.6.7.8", 2), ShouldBeTrue)
+
+		c.remove("1.2.3.4")
+		So(c.add("1.2.3.4", 2), ShouldBeTrue)
+
+		c.remove("1.2.3.4")
+		c.remove("1.2.3.4")
+		c.remove("5.6.7.8")
+		So(c.counts, ShouldBeEmpty)
+	})
+	Convey("Client IP", t, func() {
+		So(clientIP(nil), ShouldEqual, "")
+		So(clientIP(&net.IPAddr{IP: net.ParseIP("1.2.3.4")}), ShouldEqual, "1.2.3.4")
+		So(clientIP(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}), ShouldEqual, "2001:db8::1")
+	})
+	Convey("Relay client IP", t, func() {
+		v4 := &net.IPAddr{IP: net.ParseIP("1.2.3.4")}
+		v6 := &net.IPAddr{IP: net.ParseIP("2001:db8:1:2::1")}
+		So(relayClientIP(nil, ClientIPFull), ShouldEqual, "")
+		So(relayClientIP(v4, ""), ShouldEqual, "1.2.3.4")
+		So(relayClientIP(v4, ClientIPFull), ShouldEqual, "1.2.3.4")
+		So(relayClientIP(v6, ClientIPFull), ShouldEqual, "2001:db8:1:2::1")
+		So(relayClientIP(v4, ClientIPTruncated), ShouldEqual, "1.2.3.0")
+		So(relayClientIP(v6, ClientIPTruncated), ShouldEqual, "2001:db8:1::")
+		So(relayClientIP(v4, ClientIPNone), ShouldEqual, "")
+
+		So(ClientIPMode("").valid(), ShouldBeTrue)
+		So(ClientIPTruncated.valid(), ShouldBeTrue)
+		So(ClientIPMode("hashed").valid(), ShouldBeFalse)
+	})
+	Convey("Normalize client IP", t, func() {
+		So(normalizeClientIP(nil), ShouldEqual, "")
+		So(normalizeClientIP(&net.IPAddr{IP: net.ParseIP("1.2.3.4")}), ShouldEqual, "1.2.3.4")
+		So(normalizeClientIP(&net.IPAddr{IP: net.ParseIP("2001:db8::1")}), ShouldEqual, "2001:db8::1")
+		So(normalizeClientIP(&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}), ShouldEqual, "fe80::1")
+		So(normalizeClientIP(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1, Zone: "eth0"}), ShouldEqual, "fe80::1")
+
+		// Addresses of other types are parsed from their string form.
+		So(normalizeClientIP(stringAddr("1.2.3.4")), ShouldEqual, "1.2.3.4")
+		So(normalizeClientIP(stringAddr("1.2.3.4:5")), ShouldEqual, "1.2.3.4")
+		So(normalizeClientIP(stringAddr("[2001:db8::1]:5")), ShouldEqual, "2001:db8::1")
+		So(normalizeClientIP(stringAddr("fe80::1%eth0")), ShouldEqual, "fe80::1")
+		So(normalizeClientIP(stringAddr("[fe80::1%eth0]:5")), ShouldEqual, "fe80::1")
+		So(normalizeClientIP(stringAddr("not an address")), ShouldEqual, "")
+
+		So(relayClientIP(&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, ClientIPFull), ShouldEqual, "fe80::1")
+	})
+}
+
+// stringAddr is a net.Addr of no particular network.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "" }
+func (a stringAddr) String() string  { return string(a) }
@@ -0,0 +1,43 @@
+package snowflake_proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// connSet is the set of connections of the sessions in progress, so that they
+// can be closed when the proxy must stop. The zero value is an empty set.
+type connSet struct {
+	lock  sync.Mutex
+	conns map[io.Closer]struct{}
+}
+
+// add adds conn to the set.
+func (s *connSet) add(conn io.Closer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[io.Closer]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+// remove removes conn from the set.
+func (s *connSet) remove(conn io.Closer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeAll closes all the connections in the set and empties it. It returns
+// the number of connections closed.
+func (s *connSet) closeAll() int {
+	s.lock.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.lock.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
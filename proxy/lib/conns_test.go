@@ -0,0 +1,29 @@
+package snowflake_proxy
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConnSet(t *testing.T) {
+	Convey("Connection set", t, func() {
+		var s connSet
+		So(s.closeAll(), ShouldEqual, 0)
+
+		c1, s1 := net.Pipe()
+		c2, s2 := net.Pipe()
+		s.add(s1)
+		s.add(s2)
+		s.remove(s2)
+		So(s.closeAll(), ShouldEqual, 1)
+
+		_, err := c1.Write([]byte("a"))
+		So(err, ShouldNotBeNil)
+		go s2.Read(make([]byte, 1))
+		_, err = c2.Write([]byte("a"))
+		So(err, ShouldBeNil)
+		So(s.closeAll(), ShouldEqual, 0)
+	})
+}
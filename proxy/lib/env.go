@@ -0,0 +1,130 @@
+package snowflake_proxy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SnowflakeProxyFromEnv returns a SnowflakeProxy configured from environment
+// variables, for deployments such as containers where that is easier than
+// command line flags. The variables and the fields they set are:
+//
+//	SNOWFLAKE_BROKER_URL                          BrokerURL
+//	SNOWFLAKE_STUN_URL                            STUNURL
+//	SNOWFLAKE_RELAY_URL                           RelayURL
+//	SNOWFLAKE_NAT_PROBE_URL                       NATProbeURL
+//	SNOWFLAKE_CAPACITY                            Capacity
+//	SNOWFLAKE_POLL_INTERVAL                       PollInterval
+//	SNOWFLAKE_NAT_RETEST_INTERVAL                 NATTypeMeasurementInterval
+//	SNOWFLAKE_SUMMARY_INTERVAL                    SummaryInterval
+//	SNOWFLAKE_RELAY_DOMAIN_NAME_PATTERN           RelayDomainNamePattern
+//	SNOWFLAKE_OUTBOUND_ADDRESS                    OutboundAddress
+//	SNOWFLAKE_KEEP_LOCAL_ADDRESSES                KeepLocalAddresses
+//	SNOWFLAKE_ALLOW_PROXYING_TO_PRIVATE_ADDRESSES AllowProxyingToPrivateAddresses
+//	SNOWFLAKE_ALLOW_NON_TLS_RELAY                 AllowNonTLSRelay
+//	SNOWFLAKE_DISABLE_NAT_PROBE                   DisableNATProbe
+//	SNOWFLAKE_CLIENT_IP_MODE                      ClientIPMode
+//	SNOWFLAKE_METRICS_ADDRESS                     MetricsListenAddr
+//	SNOWFLAKE_HEALTH_ADDRESS                      HealthListenAddr
+//
+// Durations are in the format of time.ParseDuration, and booleans in that of
+// strconv.ParseBool. Unset variables leave the defaults of the standalone
+// proxy. An error is returned if a variable cannot be parsed.
+func SnowflakeProxyFromEnv() (*SnowflakeProxy, error) {
+	return snowflakeProxyFromLookup(os.LookupEnv)
+}
+
+// snowflakeProxyFromLookup is SnowflakeProxyFromEnv, with the environment
+// variables looked up by lookup.
+func snowflakeProxyFromLookup(lookup func(string) (string, bool)) (*SnowflakeProxy, error) {
+	sf := &SnowflakeProxy{
+		PollInterval:               DefaultPollInterval,
+		BrokerURL:                  DefaultBrokerURL,
+		STUNURL:                    DefaultSTUNURL,
+		RelayURL:                   DefaultRelayURL,
+		NATProbeURL:                DefaultNATProbeURL,
+		RelayDomainNamePattern:     DefaultRelayDomainNamePattern,
+		NATTypeMeasurementInterval: 24 * time.Hour,
+		SummaryInterval:            time.Hour,
+	}
+	var clientIPMode string
+	env := envParser{lookup: lookup}
+	env.string("SNOWFLAKE_BROKER_URL", &sf.BrokerURL)
+	env.string("SNOWFLAKE_STUN_URL", &sf.STUNURL)
+	env.string("SNOWFLAKE_RELAY_URL", &sf.RelayURL)
+	env.string("SNOWFLAKE_NAT_PROBE_URL", &sf.NATProbeURL)
+	env.uint("SNOWFLAKE_CAPACITY", &sf.Capacity)
+	env.duration("SNOWFLAKE_POLL_INTERVAL", &sf.PollInterval)
+	env.duration("SNOWFLAKE_NAT_RETEST_INTERVAL", &sf.NATTypeMeasurementInterval)
+	env.duration("SNOWFLAKE_SUMMARY_INTERVAL", &sf.SummaryInterval)
+	env.string("SNOWFLAKE_RELAY_DOMAIN_NAME_PATTERN", &sf.RelayDomainNamePattern)
+	env.string("SNOWFLAKE_OUTBOUND_ADDRESS", &sf.OutboundAddress)
+	env.bool("SNOWFLAKE_KEEP_LOCAL_ADDRESSES", &sf.KeepLocalAddresses)
+	env.bool("SNOWFLAKE_ALLOW_PROXYING_TO_PRIVATE_ADDRESSES", &sf.AllowProxyingToPrivateAddresses)
+	env.bool("SNOWFLAKE_ALLOW_NON_TLS_RELAY", &sf.AllowNonTLSRelay)
+	env.bool("SNOWFLAKE_DISABLE_NAT_PROBE", &sf.DisableNATProbe)
+	env.string("SNOWFLAKE_CLIENT_IP_MODE", &clientIPMode)
+	env.string("SNOWFLAKE_METRICS_ADDRESS", &sf.MetricsListenAddr)
+	env.string("SNOWFLAKE_HEALTH_ADDRESS", &sf.HealthListenAddr)
+	if env.err != nil {
+		return nil, env.err
+	}
+	sf.ClientIPMode = ClientIPMode(clientIPMode)
+	if !sf.ClientIPMode.valid() {
+		return nil, fmt.Errorf("invalid SNOWFLAKE_CLIENT_IP_MODE %q", clientIPMode)
+	}
+	return sf, nil
+}
+
+// envParser parses environment variables into the fields of a
+// SnowflakeProxy, keeping the first error.
+type envParser struct {
+	lookup func(string) (string, bool)
+	err    error
+}
+
+// parse calls set with the value of the variable name, if it is set and no
+// error occurred yet.
+func (p *envParser) parse(name string, set func(value string) error) {
+	if p.err != nil {
+		return
+	}
+	value, ok := p.lookup(name)
+	if !ok {
+		return
+	}
+	if err := set(value); err != nil {
+		p.err = fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+}
+
+func (p *envParser) string(name string, dst *string) {
+	p.parse(name, func(value string) error {
+		*dst = value
+		return nil
+	})
+}
+
+func (p *envParser) uint(name string, dst *uint) {
+	p.parse(name, func(value string) error {
+		n, err := strconv.ParseUint(value, 10, 0)
+		*dst = uint(n)
+		return err
+	})
+}
+
+func (p *envParser) bool(name string, dst *bool) {
+	p.parse(name, func(value string) (err error) {
+		*dst, err = strconv.ParseBool(value)
+		return err
+	})
+}
+
+func (p *envParser) duration(name string, dst *time.Duration) {
+	p.parse(name, func(value string) (err error) {
+		*dst, err = time.ParseDuration(value)
+		return err
+	})
+}
@@ -0,0 +1,54 @@
+package snowflake_proxy
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnowflakeProxyFromEnv(t *testing.T) {
+	lookup := func(env map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}
+	}
+	Convey("Defaults", t, func() {
+		sf, err := snowflakeProxyFromLookup(lookup(nil))
+		So(err, ShouldBeNil)
+		So(sf.BrokerURL, ShouldEqual, DefaultBrokerURL)
+		So(sf.STUNURL, ShouldEqual, DefaultSTUNURL)
+		So(sf.RelayDomainNamePattern, ShouldEqual, DefaultRelayDomainNamePattern)
+		So(sf.Capacity, ShouldEqual, 0)
+	})
+	Convey("Variables", t, func() {
+		sf, err := snowflakeProxyFromLookup(lookup(map[string]string{
+			"SNOWFLAKE_BROKER_URL":        "https://broker.example/",
+			"SNOWFLAKE_STUN_URL":          "stun:stun.example:3478",
+			"SNOWFLAKE_CAPACITY":          "10",
+			"SNOWFLAKE_POLL_INTERVAL":     "30s",
+			"SNOWFLAKE_DISABLE_NAT_PROBE": "true",
+			"SNOWFLAKE_CLIENT_IP_MODE":    "none",
+		}))
+		So(err, ShouldBeNil)
+		So(sf.BrokerURL, ShouldEqual, "https://broker.example/")
+		So(sf.STUNURL, ShouldEqual, "stun:stun.example:3478")
+		So(sf.Capacity, ShouldEqual, 10)
+		So(sf.PollInterval, ShouldEqual, 30*time.Second)
+		So(sf.DisableNATProbe, ShouldBeTrue)
+		So(sf.ClientIPMode, ShouldEqual, ClientIPNone)
+	})
+	Convey("Malformed variables", t, func() {
+		for _, env := range []map[string]string{
+			{"SNOWFLAKE_CAPACITY": "ten"},
+			{"SNOWFLAKE_CAPACITY": "-1"},
+			{"SNOWFLAKE_POLL_INTERVAL": "30"},
+			{"SNOWFLAKE_KEEP_LOCAL_ADDRESSES": "maybe"},
+			{"SNOWFLAKE_CLIENT_IP_MODE": "hashed"},
+		} {
+			_, err := snowflakeProxyFromLookup(lookup(env))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
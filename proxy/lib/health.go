@@ -0,0 +1,78 @@
+package snowflake_proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+)
+
+// healthCheck is an event listener that serves the proxy's readiness over
+// HTTP. The proxy is ready once its NAT type has been determined and as long
+// as its most recent poll to the broker succeeded.
+type healthCheck struct {
+	lock          sync.Mutex
+	natDetermined bool
+	pollSucceeded bool
+
+	server *http.Server
+}
+
+func newHealthCheck() *healthCheck {
+	return &healthCheck{}
+}
+
+func (h *healthCheck) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch e.(type) {
+	case *event.EventOnCurrentNATTypeDetermined:
+		h.natDetermined = true
+	case event.EventOnProxyPollSucceeded:
+		h.pollSucceeded = true
+	case event.EventOnProxyPollFailed:
+		h.pollSucceeded = false
+	}
+}
+
+func (h *healthCheck) ready() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.natDetermined && h.pollSucceeded
+}
+
+func (h *healthCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.ready() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Start serves the health check on the given address.
+func (h *healthCheck) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/health", h)
+	h.server = &http.Server{Handler: mux}
+	go func() {
+		if err := h.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the health check server.
+func (h *healthCheck) Close() error {
+	if h.server == nil {
+		return nil
+	}
+	return h.server.Close()
+}
@@ -0,0 +1,35 @@
+package snowflake_proxy
+
+import (
+	"context"
+	"log"
+	"log/slog"
+)
+
+// logFunc is the signature of SnowflakeProxy.logMsg, which the parts of the
+// proxy that log on its behalf, such as the SignalingServer, are given.
+type logFunc func(level slog.Level, msg string, attrs ...slog.Attr)
+
+// with returns a logFunc that also adds attrs to every message.
+func (f logFunc) with(attrs ...slog.Attr) logFunc {
+	return func(level slog.Level, msg string, more ...slog.Attr) {
+		f(level, msg, append(more[:len(more):len(more)], attrs...)...)
+	}
+}
+
+// defaultLogMsg writes msg with the log package and drops the attributes. It
+// is used when no Logger is set.
+func defaultLogMsg(level slog.Level, msg string, attrs ...slog.Attr) {
+	log.Print(msg)
+}
+
+// logMsg logs msg through sf.Logger at the given level, with the given
+// attributes. If sf.Logger is nil, msg is written with the log package
+// instead, as it always has been, and the attributes are dropped.
+func (sf *SnowflakeProxy) logMsg(level slog.Level, msg string, attrs ...slog.Attr) {
+	if sf.Logger == nil {
+		defaultLogMsg(level, msg, attrs...)
+		return
+	}
+	sf.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
@@ -1,6 +1,7 @@
 package snowflake_proxy
 
 import (
+	"net"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,6 +17,11 @@ type Metrics struct {
 	totalInBoundTraffic  prometheus.Counter
 	totalOutBoundTraffic prometheus.Counter
 	totalConnections     prometheus.Counter
+	activeConnections    prometheus.Gauge
+	totalPollFailures    prometheus.Counter
+	natType              *prometheus.GaugeVec
+
+	server *http.Server
 }
 
 func NewMetrics() *Metrics {
@@ -35,25 +41,64 @@ func NewMetrics() *Metrics {
 			Name:      "traffic_outbound_bytes_total",
 			Help:      "The total out bound traffic by the snowflake proxy (KB)",
 		}),
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "connections_active",
+			Help:      "The number of clients currently connected to the snowflake proxy",
+		}),
+		totalPollFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "broker_poll_failures_total",
+			Help:      "The total number of failed polls to the broker",
+		}),
+		natType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "nat_type",
+			Help:      "The current NAT type of the snowflake proxy, set to 1 for the current type",
+		}, []string{"type"}),
 	}
 }
 
 // Start register the metrics server and serve them on the given address
 func (m *Metrics) Start(addr string) error {
+	if err := prometheus.Register(m); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		prometheus.Unregister(m)
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/internal/metrics", promhttp.Handler())
+	m.server = &http.Server{Handler: mux}
 	go func() {
-		http.Handle("/internal/metrics", promhttp.Handler())
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		if err := m.server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			panic(err)
 		}
 	}()
 
-	return prometheus.Register(m)
+	return nil
+}
+
+// Close stops the metrics server and unregisters the metrics
+func (m *Metrics) Close() error {
+	prometheus.Unregister(m)
+	if m.server == nil {
+		return nil
+	}
+	return m.server.Close()
 }
 
 func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
 	m.totalConnections.Collect(ch)
 	m.totalInBoundTraffic.Collect(ch)
 	m.totalOutBoundTraffic.Collect(ch)
+	m.activeConnections.Collect(ch)
+	m.totalPollFailures.Collect(ch)
+	m.natType.Collect(ch)
 }
 
 func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
@@ -74,3 +119,24 @@ func (m *Metrics) TrackOutBoundTraffic(value int64) {
 func (m *Metrics) TrackNewConnection() {
 	m.totalConnections.Inc()
 }
+
+// TrackClientConnected counts a client that is now connected
+func (m *Metrics) TrackClientConnected() {
+	m.activeConnections.Inc()
+}
+
+// TrackClientDisconnected counts a client that is no longer connected
+func (m *Metrics) TrackClientDisconnected() {
+	m.activeConnections.Dec()
+}
+
+// TrackPollFailure counts the failed polls to the broker
+func (m *Metrics) TrackPollFailure() {
+	m.totalPollFailures.Inc()
+}
+
+// TrackNATType records the current NAT type of the snowflake proxy
+func (m *Metrics) TrackNATType(natType string) {
+	m.natType.Reset()
+	m.natType.WithLabelValues(natType).Set(1)
+}
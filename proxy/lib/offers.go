@@ -0,0 +1,37 @@
+package snowflake_proxy
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// offerSet is the set of client offers for which a session is in progress,
+// identified by a hash of their SDP. The zero value is an empty set.
+type offerSet struct {
+	lock   sync.Mutex
+	offers map[[sha256.Size]byte]struct{}
+}
+
+// add adds the offer with the given SDP to the set, and returns false if it
+// was already in it.
+func (s *offerSet) add(sdp string) bool {
+	key := sha256.Sum256([]byte(sdp))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.offers[key]; ok {
+		return false
+	}
+	if s.offers == nil {
+		s.offers = make(map[[sha256.Size]byte]struct{})
+	}
+	s.offers[key] = struct{}{}
+	return true
+}
+
+// remove removes the offer with the given SDP from the set.
+func (s *offerSet) remove(sdp string) {
+	key := sha256.Sum256([]byte(sdp))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.offers, key)
+}
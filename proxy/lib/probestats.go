@@ -0,0 +1,76 @@
+package snowflake_proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// natProbeWindow is the number of recent NAT probes that NATProbeStats covers.
+const natProbeWindow = 10
+
+// NATProbeStats summarizes the most recent NAT type probes.
+type NATProbeStats struct {
+	// Probes is the number of probes covered, at most natProbeWindow.
+	Probes int
+	// Successes is the number of those probes that determined a NAT type.
+	Successes int
+	// AverageDuration is the average duration of those probes.
+	AverageDuration time.Duration
+	// LastDuration is the duration of the most recent probe.
+	LastDuration time.Duration
+}
+
+// SuccessRate returns the fraction of the probes that succeeded, or 0 if
+// there were none.
+func (s NATProbeStats) SuccessRate() float64 {
+	if s.Probes == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Probes)
+}
+
+type natProbeResult struct {
+	duration time.Duration
+	success  bool
+}
+
+// natProbeResults keeps the results of the most recent NAT probes. The zero
+// value holds no results.
+type natProbeResults struct {
+	lock    sync.Mutex
+	results [natProbeWindow]natProbeResult
+	// n is the number of results held, and next is the index the next
+	// result is stored at.
+	n, next int
+}
+
+func (r *natProbeResults) add(duration time.Duration, success bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results[r.next] = natProbeResult{duration: duration, success: success}
+	r.next = (r.next + 1) % natProbeWindow
+	if r.n < natProbeWindow {
+		r.n++
+	}
+}
+
+func (r *natProbeResults) stats() NATProbeStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var stats NATProbeStats
+	if r.n == 0 {
+		return stats
+	}
+	var total time.Duration
+	for i := 0; i < r.n; i++ {
+		result := r.results[i]
+		total += result.duration
+		if result.success {
+			stats.Successes++
+		}
+	}
+	stats.Probes = r.n
+	stats.AverageDuration = total / time.Duration(r.n)
+	stats.LastDuration = r.results[(r.next+natProbeWindow-1)%natProbeWindow].duration
+	return stats
+}
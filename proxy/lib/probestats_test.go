@@ -0,0 +1,35 @@
+package snowflake_proxy
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNATProbeResults(t *testing.T) {
+	Convey("NAT probe results", t, func() {
+		var r natProbeResults
+		stats := r.stats()
+		So(stats.Probes, ShouldEqual, 0)
+		So(stats.SuccessRate(), ShouldEqual, 0)
+
+		r.add(1*time.Second, true)
+		r.add(3*time.Second, false)
+		stats = r.stats()
+		So(stats.Probes, ShouldEqual, 2)
+		So(stats.Successes, ShouldEqual, 1)
+		So(stats.SuccessRate(), ShouldEqual, 0.5)
+		So(stats.AverageDuration, ShouldEqual, 2*time.Second)
+		So(stats.LastDuration, ShouldEqual, 3*time.Second)
+
+		// Only the most recent results are kept.
+		for i := 0; i < natProbeWindow; i++ {
+			r.add(time.Duration(i+1)*time.Second, true)
+		}
+		stats = r.stats()
+		So(stats.Probes, ShouldEqual, natProbeWindow)
+		So(stats.Successes, ShouldEqual, natProbeWindow)
+		So(stats.LastDuration, ShouldEqual, natProbeWindow*time.Second)
+	})
+}
@@ -2,16 +2,31 @@ package snowflake_proxy
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	. "github.com/smartystreets/goconvey/convey"
+	snowflakeClient "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/util"
 )
@@ -32,6 +47,60 @@ func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r, nil
 }
 
+// Set up a mock transport that records the last request it received, and
+// the paths of all of them. If bodies has an entry for a request's path, it
+// is the body of the response instead of that of the MockTransport.
+type RecordingTransport struct {
+	MockTransport
+	bodies map[string][]byte
+
+	lock  sync.Mutex
+	req   *http.Request
+	paths []string
+}
+
+func (r *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.lock.Lock()
+	r.req = req
+	r.paths = append(r.paths, req.URL.Path)
+	r.lock.Unlock()
+	if body, ok := r.bodies[req.URL.Path]; ok {
+		return (&MockTransport{r.statusOverride, body}).RoundTrip(req)
+	}
+	return r.MockTransport.RoundTrip(req)
+}
+
+// requests returns the number of requests received for path.
+func (r *RecordingTransport) requests(path string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for _, p := range r.paths {
+		if p == path {
+			n++
+		}
+	}
+	return n
+}
+
+// FlakyTransport responds with each of statuses in turn, then with the
+// status of its MockTransport.
+type FlakyTransport struct {
+	MockTransport
+	statuses []int
+	requests int
+}
+
+func (f *FlakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests++
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		return (&MockTransport{statusOverride: status}).RoundTrip(req)
+	}
+	return f.MockTransport.RoundTrip(req)
+}
+
 // Set up a mock faulty transport
 type FaultyTransport struct {
 	statusOverride int
@@ -253,6 +322,62 @@ c=IN IP7 1.2.3.4
 	}
 }
 
+func TestHasServerReflexiveCandidate(t *testing.T) {
+	Convey("Server reflexive candidate detection", t, func() {
+		const hostOnly = "v=0\r\no=- 4358805017720277108 2 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 0.0.0.0\r\na=candidate:3769337065 1 udp 2122260223 1.2.3.4 56688 typ host generation 0 network-id 1 network-cost 50\r\n"
+		const withSrflx = hostOnly + "a=candidate:2082671819 1 udp 1686052607 1.2.3.4 54653 typ srflx raddr 192.168.0.1 rport 54653 generation 0 network-id 1 network-cost 50\r\n"
+
+		So(hasServerReflexiveCandidate(hostOnly), ShouldBeFalse)
+		So(hasServerReflexiveCandidate(withSrflx), ShouldBeTrue)
+		So(hasServerReflexiveCandidate("not sdp"), ShouldBeFalse)
+	})
+}
+
+func TestFilterCandidates(t *testing.T) {
+	Convey("ICE candidate filtering", t, func() {
+		const header = "v=0\r\no=- 4358805017720277108 2 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 0.0.0.0\r\n"
+		const ipv4 = "a=candidate:3769337065 1 udp 2122260223 1.2.3.4 56688 typ host generation 0\r\n"
+		const ipv6 = "a=candidate:3769337066 1 udp 2122260222 2001:db8::1 56689 typ host generation 0\r\n"
+
+		var seen []string
+		filtered := filterCandidates(header+ipv4+ipv6, func(candidate string) bool {
+			seen = append(seen, candidate)
+			return !strings.Contains(candidate, ":db8:")
+		})
+		So(seen, ShouldResemble, []string{
+			strings.TrimSuffix(strings.TrimPrefix(ipv4, "a="), "\r\n"),
+			strings.TrimSuffix(strings.TrimPrefix(ipv6, "a="), "\r\n"),
+		})
+		So(filtered, ShouldContainSubstring, "1.2.3.4")
+		So(filtered, ShouldNotContainSubstring, "2001:db8::1")
+
+		So(filterCandidates("not sdp", func(string) bool { return false }), ShouldEqual, "not sdp")
+	})
+}
+
+func TestCheckOffer(t *testing.T) {
+	Convey("Offer sanity check", t, func() {
+		const header = "v=0\r\no=- 4358805017720277108 2 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+		const media = "m=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 0.0.0.0\r\n"
+		const attributes = "a=ice-ufrag:aMAZ\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\na=fingerprint:sha-256 C8:88:EE:B9:E7:02:2E:21:37:ED:7A:D1:EB:2B:A3:15:A2:3B:5B:1C:3D:D4:D5:1F:06:CF:52:40:03:F8:DD:66\r\n"
+		offer := func(sdp string) *webrtc.SessionDescription {
+			return &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+		}
+
+		So(checkOffer(offer(header+media+attributes), 0), ShouldBeNil)
+		// The attributes may also be at the session level.
+		So(checkOffer(offer(header+attributes+media), 0), ShouldBeNil)
+		So(checkOffer(offer(header+media+attributes), 1000), ShouldBeNil)
+
+		So(checkOffer(offer(header+media+attributes), 100), ShouldNotBeNil)
+		So(checkOffer(offer(header+attributes), 0), ShouldNotBeNil)
+		So(checkOffer(offer(header+"m=audio 56688 RTP/AVP 0\r\n"+attributes), 0), ShouldNotBeNil)
+		So(checkOffer(offer(header+media), 0), ShouldNotBeNil)
+		So(checkOffer(offer("not sdp"), 0), ShouldNotBeNil)
+		So(checkOffer(&webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: header + media + attributes}, 0), ShouldNotBeNil)
+	})
+}
+
 func TestSessionDescriptions(t *testing.T) {
 	Convey("Session description deserialization", t, func() {
 		for _, test := range []struct {
@@ -335,13 +460,11 @@ func TestBrokerInteractions(t *testing.T) {
 	const sampleAnswer = `{"type":"answer","sdp":` + sampleSDP + `}`
 
 	Convey("Proxy connections to broker", t, func() {
-		var err error
-		broker, err = newSignalingServer("localhost")
+		broker, err := newSignalingServer("localhost", nil)
 		So(err, ShouldBeNil)
-		tokens = newTokens(0)
 
 		//Mock peerConnection
-		config = webrtc.Configuration{
+		config := webrtc.Configuration{
 			ICEServers: []webrtc.ICEServer{
 				{
 					URLs: []string{"stun:stun.l.google.com:19302"},
@@ -364,10 +487,125 @@ func TestBrokerInteractions(t *testing.T) {
 				b,
 			}
 
-			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "")
+			sdp, _, _, err := broker.pollOffer(sampleOffer, DefaultProxyType, NATUnknown, "", 0)
+			So(err, ShouldBeNil)
 			expectedSDP, _ := strconv.Unquote(sampleSDP)
 			So(sdp.SDP, ShouldResemble, expectedSDP)
 		})
+		Convey("tags poll requests with session and request IDs", func() {
+			b, err := messages.EncodePollResponse("", false, "")
+			So(err, ShouldBeNil)
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, b}}
+			broker.transport = transport
+
+			_, _, _, err = broker.pollOffer("sid", DefaultProxyType, NATUnknown, "", 0)
+			So(err, ShouldBeNil)
+			So(transport.req.Header.Get("X-Session-ID"), ShouldEqual, "sid")
+			So(transport.req.Header.Get("X-Request-ID"), ShouldNotBeEmpty)
+		})
+		Convey("logs through the proxy's Logger", func() {
+			var buf bytes.Buffer
+			sf := SnowflakeProxy{Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+			broker.logMsg = sf.logMsg
+			broker.transport = &MockTransport{http.StatusInternalServerError, nil}
+
+			_, _, _, err := broker.pollOffer("sid", DefaultProxyType, NATUnknown, "", 0)
+			So(err, ShouldNotBeNil)
+			So(buf.String(), ShouldContainSubstring, `"session_id":"sid"`)
+			So(buf.String(), ShouldContainSubstring, `"status_code":500`)
+		})
+		Convey("sends the client NAT types it serves in polls", func() {
+			b, err := messages.EncodePollResponse("", false, "")
+			So(err, ShouldBeNil)
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, b}}
+			broker.transport = transport
+			broker.clientNATTypes = []string{NATUnrestricted}
+
+			_, _, _, err = broker.pollOffer("sid", DefaultProxyType, NATUnknown, "", 0)
+			So(err, ShouldBeNil)
+			var request messages.ProxyPollRequest
+			So(json.NewDecoder(transport.req.Body).Decode(&request), ShouldBeNil)
+			So(request.AcceptedClientNATTypes, ShouldResemble, []string{NATUnrestricted})
+		})
+		Convey("drops offers for which a session is in progress", func() {
+			b, err := messages.EncodePollResponse(sampleOffer, true, NATUnknown)
+			So(err, ShouldBeNil)
+			answerResponse, err := messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+			transport := &RecordingTransport{
+				MockTransport: MockTransport{http.StatusOK, b},
+				bodies:        map[string][]byte{"/answer": answerResponse},
+			}
+			broker.transport = transport
+			broker.url, _ = url.Parse("https://broker.example/")
+
+			sf := SnowflakeProxy{
+				EventDispatcher:         event.NewSnowflakeEventDispatcher(),
+				ClientConnectionTimeout: time.Second,
+				broker:                  broker,
+				tokens:                  newTokens(0),
+			}
+
+			// The first session waits for the client, which never
+			// connects, until it times out.
+			sf.tokens.Get()
+			sf.sessions.Add(1)
+			done := make(chan struct{})
+			go func() {
+				sf.runSession("sid1")
+				close(done)
+			}()
+			deadline := time.Now().Add(5 * time.Second)
+			for transport.requests("/answer") == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(transport.requests("/answer"), ShouldEqual, 1)
+
+			// The broker hands out the same offer again meanwhile.
+			sf.tokens.Get()
+			sf.sessions.Add(1)
+			sf.runSession("sid2")
+			So(transport.requests("/proxy"), ShouldEqual, 2)
+			So(transport.requests("/answer"), ShouldEqual, 1)
+
+			// Once the first session is over, the offer is accepted
+			// again.
+			<-done
+			sf.ClientConnectionTimeout = time.Millisecond
+			sf.tokens.Get()
+			sf.sessions.Add(1)
+			sf.runSession("sid3")
+			So(transport.requests("/answer"), ShouldEqual, 2)
+			So(sf.tokens.Count(), ShouldEqual, 0)
+		})
+		Convey("rejects offers from client NAT types it does not serve", func() {
+			b, err := messages.EncodePollResponse(sampleOffer, true, NATRestricted)
+			So(err, ShouldBeNil)
+			broker.transport = &MockTransport{http.StatusOK, b}
+
+			recorder := &eventRecorder{}
+			sf := SnowflakeProxy{
+				EventDispatcher:     event.NewSnowflakeEventDispatcher(),
+				ServeClientNATTypes: []string{NATUnrestricted},
+				broker:              broker,
+				tokens:              newTokens(0),
+			}
+			sf.EventDispatcher.AddSnowflakeEventListener(recorder)
+
+			sf.tokens.Get()
+			sf.sessions.Add(1)
+			sf.runSession("sid")
+			So(sf.tokens.Count(), ShouldEqual, 0)
+
+			var rejected []event.EventOnProxyOfferRejected
+			for _, e := range recorder.events {
+				if e, ok := e.(event.EventOnProxyOfferRejected); ok {
+					rejected = append(rejected, e)
+				}
+			}
+			So(rejected, ShouldHaveLength, 1)
+			So(rejected[0].SessionID, ShouldEqual, "sid")
+		})
 		Convey("handles poll error", func() {
 			var err error
 
@@ -378,7 +616,8 @@ func TestBrokerInteractions(t *testing.T) {
 				b,
 			}
 
-			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "")
+			sdp, _, _, err := broker.pollOffer(sampleOffer, DefaultProxyType, NATUnknown, "", 0)
+			So(err, ShouldNotBeNil)
 			So(sdp, ShouldBeNil)
 		})
 		Convey("sends answer to broker", func() {
@@ -404,6 +643,78 @@ func TestBrokerInteractions(t *testing.T) {
 			err = broker.sendAnswer(sampleAnswer, pc)
 			So(err, ShouldNotBeNil)
 		})
+		Convey("waits for a host candidate", func() {
+			candidates := make(chan *webrtc.ICECandidate, 2)
+			candidates <- &webrtc.ICECandidate{Typ: webrtc.ICECandidateTypeSrflx}
+			So(waitForHostCandidate(candidates, 10*time.Millisecond), ShouldBeFalse)
+			candidates <- &webrtc.ICECandidate{Typ: webrtc.ICECandidateTypeHost}
+			So(waitForHostCandidate(candidates, time.Second), ShouldBeTrue)
+			close(candidates)
+			So(waitForHostCandidate(candidates, time.Second), ShouldBeTrue)
+		})
+		Convey("retries answer on transient errors", func() {
+			b, err := messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+
+			transport := &FlakyTransport{
+				MockTransport: MockTransport{http.StatusOK, b},
+				statuses:      []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			}
+			broker.transport = transport
+			err = broker.sendAnswer(sampleAnswer, pc)
+			So(err, ShouldBeNil)
+			So(transport.requests, ShouldEqual, 3)
+
+			// Client errors are not retried.
+			transport = &FlakyTransport{
+				MockTransport: MockTransport{http.StatusOK, b},
+				statuses:      []int{http.StatusGone},
+			}
+			broker.transport = transport
+			err = broker.sendAnswer(sampleAnswer, pc)
+			So(err, ShouldNotBeNil)
+			So(transport.requests, ShouldEqual, 1)
+
+			// Neither is a client timeout reported by the broker.
+			b, err = messages.EncodeAnswerResponse(false)
+			So(err, ShouldBeNil)
+			transport = &FlakyTransport{MockTransport: MockTransport{http.StatusOK, b}}
+			broker.transport = transport
+			err = broker.sendAnswer(sampleAnswer, pc)
+			So(err, ShouldNotBeNil)
+			So(transport.requests, ShouldEqual, 1)
+		})
+		Convey("waits between answer retries with its clock, until shutdown", func() {
+			b, err := messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+			broker.clock = &fakeClock{}
+
+			transport := &FlakyTransport{
+				MockTransport: MockTransport{http.StatusOK, b},
+				statuses:      []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			}
+			broker.transport = transport
+			start := time.Now()
+			err = broker.sendAnswer(sampleAnswer, pc)
+			So(err, ShouldBeNil)
+			So(transport.requests, ShouldEqual, 3)
+			So(time.Since(start), ShouldBeLessThan, answerRetryDelay)
+
+			// A retry is abandoned when the proxy shuts down.
+			broker.clock = realClock{}
+			broker.shutdown = make(chan struct{})
+			close(broker.shutdown)
+			transport = &FlakyTransport{
+				MockTransport: MockTransport{http.StatusOK, b},
+				statuses:      []int{http.StatusBadGateway},
+			}
+			broker.transport = transport
+			start = time.Now()
+			err = broker.sendAnswer(sampleAnswer, pc)
+			So(err, ShouldNotBeNil)
+			So(transport.requests, ShouldEqual, 1)
+			So(time.Since(start), ShouldBeLessThan, answerRetryDelay)
+		})
 		Convey("handles answer error", func() {
 			//Error if faulty transport
 			broker.transport = &FaultyTransport{}
@@ -435,11 +746,125 @@ func TestBrokerInteractions(t *testing.T) {
 			}
 			err = broker.sendAnswer("test", pc)
 			So(err, ShouldNotBeNil)
+
+			//Larger responses are accepted with a higher read limit
+			b, err := messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+			broker.transport = &MockTransport{
+				http.StatusOK,
+				b,
+			}
+			broker.readLimit = int64(len(b)) - 1
+			_, err = broker.Post("test", nil, nil)
+			So(err, ShouldEqual, ErrResponseTooLarge)
+			broker.readLimit = int64(len(b))
+			err = broker.sendAnswer("test", pc)
+			So(err, ShouldBeNil)
+			broker.readLimit = readLimit
+		})
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	Convey("Health check", t, func() {
+		health := newHealthCheck()
+		status := func() int {
+			w := httptest.NewRecorder()
+			health.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+			return w.Code
+		}
+		So(status(), ShouldEqual, http.StatusServiceUnavailable)
+
+		health.OnNewSnowflakeEvent(event.EventOnProxyPollSucceeded{})
+		So(status(), ShouldEqual, http.StatusServiceUnavailable)
+
+		health.OnNewSnowflakeEvent(&event.EventOnCurrentNATTypeDetermined{CurNATType: NATUnrestricted})
+		So(status(), ShouldEqual, http.StatusOK)
+
+		health.OnNewSnowflakeEvent(event.EventOnProxyPollFailed{Error: fmt.Errorf("broker unreachable")})
+		So(status(), ShouldEqual, http.StatusServiceUnavailable)
+
+		health.OnNewSnowflakeEvent(event.EventOnProxyPollSucceeded{})
+		So(status(), ShouldEqual, http.StatusOK)
+	})
+	Convey("Health check after a restart", t, func() {
+		sf := SnowflakeProxy{EventDispatcher: event.NewSnowflakeEventDispatcher()}
+		// The first run found the proxy restricted.
+		sf.setCurrentNATType(NATRestricted)
+
+		// Start installs a new health check, and the probe finds the
+		// same NAT type again.
+		health := newHealthCheck()
+		sf.EventDispatcher.AddSnowflakeEventListener(health)
+		health.OnNewSnowflakeEvent(event.EventOnProxyPollSucceeded{})
+		So(health.ready(), ShouldBeFalse)
+		sf.reportInitialNATType(NATRestricted, true)
+		So(health.ready(), ShouldBeTrue)
+	})
+	Convey("Initial NAT type events", t, func() {
+		recorder := &eventRecorder{}
+		sf := SnowflakeProxy{EventDispatcher: event.NewSnowflakeEventDispatcher()}
+		sf.EventDispatcher.AddSnowflakeEventListener(recorder)
+
+		// A change is already reported by the probe.
+		sf.setCurrentNATType(NATUnrestricted)
+		sf.reportInitialNATType(NATUnknown, true)
+		So(recorder.events, ShouldBeEmpty)
+
+		// A failed probe reports the NAT type as unknown.
+		sf.reportInitialNATType(NATUnrestricted, false)
+		So(recorder.events, ShouldHaveLength, 1)
+		So(recorder.events[0], ShouldResemble, &event.EventOnCurrentNATTypeDetermined{
+			CurNATType:      NATUnknown,
+			PreviousNATType: NATUnrestricted,
 		})
+		So(sf.getCurrentNATType(), ShouldEqual, NATUnknown)
+	})
+}
+
+func TestStatusServer(t *testing.T) {
+	Convey("Status", t, func() {
+		sessions := int64(0)
+		server := newStatusServer(bytesNullLogger{}, func() int64 { return sessions })
+		status := func() proxyStatus {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var status proxyStatus
+			So(json.NewDecoder(w.Body).Decode(&status), ShouldBeNil)
+			return status
+		}
+		s := status()
+		So(s.NATType, ShouldEqual, NATUnknown)
+		So(s.ActiveSessions, ShouldEqual, 0)
+		So(s.LastPollSuccess, ShouldBeNil)
+
+		sessions = 2
+		server.OnNewSnowflakeEvent(&event.EventOnCurrentNATTypeDetermined{CurNATType: NATUnrestricted})
+		server.OnNewSnowflakeEvent(event.EventOnProxyPollSucceeded{})
+		server.OnNewSnowflakeEvent(event.EventOnProxyConnectionStarted{})
+		server.OnNewSnowflakeEvent(event.EventOnProxyConnectionStarted{})
+		server.OnNewSnowflakeEvent(event.EventOnProxyConnectionOver{})
+		server.AddInbound(10)
+		server.AddOutbound(20)
+		s = status()
+		So(s.NATType, ShouldEqual, NATUnrestricted)
+		So(s.ActiveSessions, ShouldEqual, 2)
+		So(s.ActiveConnections, ShouldEqual, 1)
+		So(s.InboundBytes, ShouldEqual, 10)
+		So(s.OutboundBytes, ShouldEqual, 20)
+		So(s.LastPollSuccess, ShouldNotBeNil)
 	})
 }
 
 func TestUtilityFuncs(t *testing.T) {
+	Convey("Traffic ratio", t, func() {
+		So(trafficRatio(0, 0), ShouldEqual, 0)
+		So(trafficRatio(100, 100), ShouldEqual, 1)
+		So(trafficRatio(100, 400), ShouldEqual, 4)
+		So(trafficRatio(400, 100), ShouldEqual, 4)
+		So(trafficRatio(1000, 0), ShouldEqual, 1000)
+	})
 	Convey("LimitedRead", t, func() {
 		c, s := net.Pipe()
 		Convey("Successful read", func() {
@@ -460,7 +885,7 @@ func TestUtilityFuncs(t *testing.T) {
 			}()
 			bytes, err := limitedRead(s, 49)
 			So(len(bytes), ShouldEqual, 49)
-			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			So(err, ShouldEqual, ErrResponseTooLarge)
 		})
 		Convey("Failed read", func() {
 			s.Close()
@@ -469,15 +894,131 @@ func TestUtilityFuncs(t *testing.T) {
 			So(err, ShouldEqual, io.ErrClosedPipe)
 		})
 	})
+	Convey("Poll backoff", t, func() {
+		base := 5 * time.Second
+		max := time.Minute
+		So(pollBackoff(base, max, 0), ShouldEqual, base)
+		So(pollBackoff(base, base, 3), ShouldEqual, base)
+		for failures := 1; failures < 10; failures++ {
+			backoff := pollBackoff(base, max, failures)
+			So(backoff, ShouldBeGreaterThanOrEqualTo, base)
+			So(backoff, ShouldBeLessThanOrEqualTo, max)
+		}
+		So(pollBackoff(base, max, 1), ShouldBeLessThanOrEqualTo, 2*base)
+	})
+	Convey("Next poll delay", t, func() {
+		base := 5 * time.Second
+		So(nextPollDelay(base, time.Minute, 1, 0), ShouldBeLessThanOrEqualTo, 2*base)
+		// Retry-After is honored even when the backoff is disabled.
+		So(nextPollDelay(base, base, 1, time.Hour), ShouldEqual, time.Hour)
+		So(nextPollDelay(base, base, 1, time.Second), ShouldEqual, base)
+		So(nextPollDelay(base, base, 1, 1000*time.Hour), ShouldEqual, maxPollRetryAfter)
+	})
+	Convey("Retry-After", t, func() {
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		So(parseRetryAfter("", now), ShouldEqual, 0)
+		So(parseRetryAfter("120", now), ShouldEqual, 2*time.Minute)
+		So(parseRetryAfter("-1", now), ShouldEqual, 0)
+		So(parseRetryAfter("Mon, 01 Jan 2024 00:00:30 GMT", now), ShouldEqual, 30*time.Second)
+		So(parseRetryAfter("Sun, 31 Dec 2023 23:00:00 GMT", now), ShouldEqual, 0)
+		So(parseRetryAfter("soon", now), ShouldEqual, 0)
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer ts.Close()
+		broker, err := newSignalingServer(ts.URL, nil)
+		So(err, ShouldBeNil)
+		_, _, _, err = broker.pollOffer("sid", DefaultProxyType, NATUnknown, "", 0)
+		var rateLimitErr rateLimitError
+		So(errors.As(err, &rateLimitErr), ShouldBeTrue)
+		So(rateLimitErr.retryAfter, ShouldEqual, time.Minute)
+		So(isRetryable(err), ShouldBeFalse)
+	})
+	Convey("Rate limiter", t, func() {
+		limiter := newRateLimiter(1000)
+		start := time.Now()
+		// The first second's worth of bytes goes through as a burst.
+		limiter.wait(1000)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+		limiter.wait(200)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+	})
+	Convey("Offer set", t, func() {
+		const offer1 = "v=0\r\na=ice-ufrag:aMAZ\r\n"
+		const offer2 = "v=0\r\na=ice-ufrag:bNBA\r\n"
+		var offers offerSet
+		So(offers.add(offer1), ShouldBeTrue)
+		So(offers.add(offer1), ShouldBeFalse)
+		So(offers.add(offer2), ShouldBeTrue)
+		offers.remove(offer1)
+		So(offers.add(offer1), ShouldBeTrue)
+	})
 	Convey("SessionID Generation", t, func() {
-		sid1 := genSessionID()
-		sid2 := genSessionID()
+		sid1, err := genSessionID()
+		So(err, ShouldBeNil)
+		sid2, err := genSessionID()
+		So(err, ShouldBeNil)
 		So(sid1, ShouldNotEqual, sid2)
+
+		sf := &SnowflakeProxy{}
+		sid, err := sf.newSessionID()
+		So(err, ShouldBeNil)
+		So(sid, ShouldNotBeEmpty)
+
+		sf.SessionIDGenerator = func() string { return "custom" }
+		sid, err = sf.newSessionID()
+		So(err, ShouldBeNil)
+		So(sid, ShouldEqual, "custom")
+	})
+	Convey("ICE servers", t, func() {
+		sf := SnowflakeProxy{STUNURL: "stun:a.example:3478,stun:b.example:3478"}
+		iceServers, err := sf.makeICEServers()
+		So(err, ShouldBeNil)
+		So(iceServers, ShouldHaveLength, 1)
+		So(iceServers[0].URLs, ShouldResemble, []string{"stun:a.example:3478", "stun:b.example:3478"})
+
+		sf.STUNURLs = []string{"stun:c.example:3478", "stun:d.example:3478"}
+		iceServers, err = sf.makeICEServers()
+		So(err, ShouldBeNil)
+		So(iceServers, ShouldHaveLength, 2)
+		So(iceServers[1].URLs, ShouldResemble, []string{"stun:d.example:3478"})
+
+		sf.STUNURLs = []string{"stun:c.example:3478", ":bad"}
+		_, err = sf.makeICEServers()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, `":bad"`)
+
+		sf.TURNURLs = []string{"turn:e.example:3478"}
+		sf.TURNUsername = "user"
+		sf.TURNCredential = "pass"
+		turnServers, err := sf.makeTURNServers()
+		So(err, ShouldBeNil)
+		So(turnServers, ShouldHaveLength, 1)
+		So(turnServers[0].Username, ShouldEqual, "user")
+		So(turnServers[0].Credential, ShouldEqual, "pass")
+		So(turnServers[0].CredentialType, ShouldEqual, webrtc.ICECredentialTypePassword)
+	})
+	Convey("Certificate check", t, func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		cert, err := webrtc.GenerateCertificate(key)
+		So(err, ShouldBeNil)
+		So(checkCertificate(cert), ShouldBeNil)
+
+		expired, err := webrtc.NewCertificate(key, x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    time.Now().Add(-2 * time.Hour),
+			NotAfter:     time.Now().Add(-time.Hour),
+		})
+		So(err, ShouldBeNil)
+		So(checkCertificate(expired), ShouldNotBeNil)
 	})
 	Convey("CopyLoop", t, func() {
 		c1, s1 := net.Pipe()
 		c2, s2 := net.Pipe()
-		go copyLoop(s1, s2, nil)
+		go copyLoop(s1, s2, nil, 0, defaultLogMsg)
 		go func() {
 			bytes := []byte("Hello!")
 			c1.Write(bytes)
@@ -493,11 +1034,99 @@ func TestUtilityFuncs(t *testing.T) {
 		_, err = s2.Write(bytes)
 		So(err, ShouldNotBeNil)
 	})
+	Convey("CopyLoop with a maximum duration", t, func() {
+		_, s1 := net.Pipe()
+		_, s2 := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			copyLoop(s1, s2, nil, 10*time.Millisecond, defaultLogMsg)
+			close(done)
+		}()
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Second):
+		}
+		So(finished, ShouldBeTrue)
+	})
+	Convey("CopyLoop with a stalled relay", t, func() {
+		c1, s1 := net.Pipe()
+		// Nothing reads from the relay's end of the pipe.
+		_, s2 := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			copyLoop(s1, newWriteTimeoutConn(s2, 10*time.Millisecond), nil, 0, defaultLogMsg)
+			close(done)
+		}()
+		go c1.Write([]byte("Hello!"))
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Second):
+		}
+		So(finished, ShouldBeTrue)
+	})
+	Convey("Relay Host and SNI overrides", t, func() {
+		sf := SnowflakeProxy{}
+		So(sf.checkRelayOverrides("ws://relay.example/"), ShouldBeNil)
+		So(sf.relayHeader(), ShouldBeNil)
+		So(sf.relayDialer(), ShouldEqual, websocket.DefaultDialer)
+
+		sf.RelayHostOverride = "front.example"
+		sf.RelaySNIOverride = "sni.example"
+		So(sf.checkRelayOverrides("wss://relay.example/"), ShouldBeNil)
+		So(sf.checkRelayOverrides("ws://relay.example/"), ShouldNotBeNil)
+		So(sf.relayHeader().Get("Host"), ShouldEqual, "front.example")
+		So(sf.relayDialer().TLSClientConfig.ServerName, ShouldEqual, "sni.example")
+		So(websocket.DefaultDialer.TLSClientConfig, ShouldBeNil)
+	})
+	Convey("Relay headers", t, func() {
+		sf := SnowflakeProxy{RelayHeaders: http.Header{}}
+		So(sf.relayHeader(), ShouldBeNil)
+
+		sf.RelayHeaders.Set("Authorization", "Bearer token")
+		sf.RelayHeaders.Set("Host", "relay.example")
+		So(sf.checkRelayHeaders(), ShouldBeNil)
+		So(sf.relayHeader().Get("Authorization"), ShouldEqual, "Bearer token")
+		So(sf.relayHeader().Get("Host"), ShouldEqual, "relay.example")
+
+		sf.RelayHostOverride = "front.example"
+		So(sf.relayHeader().Get("Host"), ShouldEqual, "front.example")
+		So(sf.relayHeader().Get("Authorization"), ShouldEqual, "Bearer token")
+		So(sf.RelayHeaders.Get("Host"), ShouldEqual, "relay.example")
+
+		sf.RelayHeaders.Set("Sec-WebSocket-Key", "key")
+		So(sf.checkRelayHeaders(), ShouldNotBeNil)
+	})
+	Convey("Client NAT types", t, func() {
+		sf := SnowflakeProxy{}
+		So(sf.checkServeClientNATTypes(), ShouldBeNil)
+		So(sf.servesClientNATType(NATRestricted), ShouldBeTrue)
+
+		sf.ServeClientNATTypes = []string{NATUnrestricted, NATUnknown}
+		So(sf.checkServeClientNATTypes(), ShouldBeNil)
+		So(sf.servesClientNATType(NATUnrestricted), ShouldBeTrue)
+		So(sf.servesClientNATType(NATRestricted), ShouldBeFalse)
+
+		sf.ServeClientNATTypes = []string{"symmetric"}
+		So(sf.checkServeClientNATTypes(), ShouldNotBeNil)
+	})
+	Convey("Relay compression", t, func() {
+		sf := SnowflakeProxy{}
+		So(sf.relayDialer().EnableCompression, ShouldBeFalse)
+
+		sf.EnableRelayCompression = true
+		So(sf.relayDialer().EnableCompression, ShouldBeTrue)
+		So(websocket.DefaultDialer.EnableCompression, ShouldBeFalse)
+	})
 	Convey("isRelayURLAcceptable", t, func() {
 		testingVector := []struct {
 			pattern               string
 			allowPrivateAddresses bool
 			allowNonTLS           bool
+			allowUnix             bool
 			targetURL             string
 			expects               error
 		}{
@@ -564,9 +1193,14 @@ func TestUtilityFuncs(t *testing.T) {
 			{pattern: "snowflake.torproject.net$", allowNonTLS: false, targetURL: "ftp://snowflake.torproject.net", expects: fmt.Errorf("")},
 			{pattern: "snowflake.torproject.net$", allowNonTLS: true, targetURL: "https://snowflake.torproject.net", expects: fmt.Errorf("")},
 			{pattern: "snowflake.torproject.net$", allowNonTLS: true, targetURL: "ftp://snowflake.torproject.net", expects: fmt.Errorf("")},
+
+			// Unix domain sockets
+			{pattern: "snowflake.torproject.net$", allowNonTLS: false, targetURL: "ws+unix:///run/snowflake.sock", expects: fmt.Errorf("")},
+			{pattern: "snowflake.torproject.net$", allowNonTLS: false, allowUnix: true, targetURL: "ws+unix:///run/snowflake.sock", expects: nil},
+			{pattern: "snowflake.torproject.net$", allowNonTLS: false, allowUnix: true, targetURL: "ws+unix://", expects: fmt.Errorf("")},
 		}
 		for _, v := range testingVector {
-			err := checkIsRelayURLAcceptable(v.pattern, v.allowPrivateAddresses, v.allowNonTLS, v.targetURL)
+			err := checkIsRelayURLAcceptable([]string{v.pattern}, v.allowPrivateAddresses, v.allowNonTLS, v.allowUnix, v.targetURL)
 			if v.expects != nil {
 				So(err, ShouldNotBeNil)
 			} else {
@@ -574,4 +1208,503 @@ func TestUtilityFuncs(t *testing.T) {
 			}
 		}
 	})
+	Convey("Multiple relay domain name patterns", t, func() {
+		patterns := []string{"snowflake.torproject.net$", "^relay.example$"}
+		So(checkIsRelayURLAcceptable(patterns, false, false, false, "wss://snowflake.torproject.net"), ShouldBeNil)
+		So(checkIsRelayURLAcceptable(patterns, false, false, false, "wss://relay.example"), ShouldBeNil)
+		So(checkIsRelayURLAcceptable(patterns, false, false, false, "wss://sub.relay.example"), ShouldNotBeNil)
+		So(checkIsRelayURLAcceptable(nil, false, false, false, "wss://relay.example"), ShouldNotBeNil)
+
+		sf := SnowflakeProxy{RelayDomainNamePatterns: patterns[1:]}
+		So(sf.relayDomainNamePatterns(), ShouldResemble, []string{"^relay.example$"})
+		So(sf.brokerRelayPattern(), ShouldEqual, "^relay.example$")
+		sf.RelayDomainNamePattern = patterns[0]
+		So(sf.relayDomainNamePatterns(), ShouldResemble, patterns)
+		So(sf.brokerRelayPattern(), ShouldEqual, patterns[0])
+		So((&SnowflakeProxy{}).brokerRelayPattern(), ShouldEqual, "")
+	})
+	Convey("Relay URL rejection reasons", t, func() {
+		reason := func(allowNonTLS bool, relayURL string) string {
+			err := checkIsRelayURLAcceptable([]string{"snowflake.torproject.net$"}, false, allowNonTLS, false, relayURL)
+			var rejectedErr *relayRejectedError
+			So(errors.As(err, &rejectedErr), ShouldBeTrue)
+			return rejectedErr.reason
+		}
+		So(reason(false, "wss://faketorproject.net"), ShouldEqual, RelayRejectedPattern)
+		So(reason(false, "ws://snowflake.torproject.net"), ShouldEqual, RelayRejectedNonTLS)
+		So(reason(true, "https://snowflake.torproject.net"), ShouldEqual, RelayRejectedProtocol)
+		So(reason(true, "ws+unix:///run/snowflake.sock"), ShouldEqual, RelayRejectedProtocol)
+		So(reason(true, "ws://192.168.1.1"), ShouldEqual, RelayRejectedPrivateAddress)
+		So(reason(true, "wss://snowflake.torproject .net"), ShouldEqual, RelayRejectedInvalidURL)
+	})
+}
+
+// fakeClock is a Clock whose time advances by step every time Now is called,
+// and whose After channels fire right away.
+type fakeClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{make(chan time.Time)}
+}
+
+// fakeTicker is a Ticker that never ticks.
+type fakeTicker struct {
+	ch chan time.Time
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.ch }
+func (t fakeTicker) Stop()               {}
+
+// eventRecorder records the events it receives.
+type eventRecorder struct {
+	events []event.SnowflakeEvent
+}
+
+func (r *eventRecorder) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	r.events = append(r.events, e)
+}
+
+func TestRunSessionClock(t *testing.T) {
+	Convey("runSession measures polls with the proxy's clock", t, func() {
+		broker, err := newSignalingServer("localhost", nil)
+		So(err, ShouldBeNil)
+		b, err := messages.EncodePollResponse("", false, "")
+		So(err, ShouldBeNil)
+		broker.transport = &MockTransport{http.StatusOK, b}
+
+		recorder := &eventRecorder{}
+		sf := SnowflakeProxy{
+			EventDispatcher: event.NewSnowflakeEventDispatcher(),
+			broker:          broker,
+			tokens:          newTokens(0),
+		}
+		sf.EventDispatcher.AddSnowflakeEventListener(recorder)
+		sf.SetClock(&fakeClock{step: 3 * time.Second})
+
+		sf.tokens.Get()
+		sf.sessions.Add(1)
+		sf.runSession("sid")
+		So(sf.tokens.Count(), ShouldEqual, 0)
+
+		So(recorder.events, ShouldNotBeEmpty)
+		pollResponse, ok := recorder.events[0].(event.EventOnProxyPollResponse)
+		So(ok, ShouldBeTrue)
+		So(pollResponse.MatchedOffer, ShouldBeFalse)
+		So(pollResponse.PollDuration, ShouldEqual, 3*time.Second)
+	})
+}
+
+func TestProxyState(t *testing.T) {
+	Convey("Proxy state", t, func() {
+		sf := SnowflakeProxy{}
+		So(sf.State(), ShouldEqual, StateStopped)
+		So(sf.State().String(), ShouldEqual, "stopped")
+
+		sf.initChannels(false)
+		sf.state.Store(int32(StateRunning))
+		sf.Stop()
+		So(sf.State(), ShouldEqual, StateStopping)
+		So(sf.pollingStopped(), ShouldBeTrue)
+
+		// Stopping again does not panic.
+		So(sf.Stop, ShouldNotPanic)
+		So(sf.State(), ShouldEqual, StateStopping)
+	})
+	Convey("Stop before Start", t, func() {
+		sf := SnowflakeProxy{}
+		So(sf.Stop, ShouldNotPanic)
+		So(sf.Stop, ShouldNotPanic)
+		So(sf.State(), ShouldEqual, StateStopped)
+		So(sf.pollingStopped(), ShouldBeTrue)
+	})
+	Convey("Restart after Stop", t, func() {
+		sf := SnowflakeProxy{}
+		pollDone := sf.initChannels(true)
+		sf.Stop()
+
+		// The first run has not ended yet, so its channels are kept.
+		So(sf.initChannels(true), ShouldEqual, pollDone)
+		So(sf.pollingStopped(), ShouldBeTrue)
+
+		close(pollDone)
+		So(sf.initChannels(true), ShouldNotEqual, pollDone)
+		So(sf.pollingStopped(), ShouldBeFalse)
+		sf.Stop()
+		So(sf.pollingStopped(), ShouldBeTrue)
+	})
+}
+
+func TestStopWithTimeout(t *testing.T) {
+	Convey("StopWithTimeout without sessions", t, func() {
+		sf := SnowflakeProxy{}
+		close(sf.initChannels(true))
+		So(sf.StopWithTimeout(time.Second), ShouldBeNil)
+		So(sf.pollingStopped(), ShouldBeTrue)
+	})
+	Convey("StopWithTimeout with a stuck session", t, func() {
+		sf := SnowflakeProxy{}
+		close(sf.initChannels(true))
+		c, s := net.Pipe()
+		sf.sessions.Add(1)
+		sf.activeConns.add(s)
+
+		So(sf.StopWithTimeout(10*time.Millisecond), ShouldNotBeNil)
+		// The session's connection was closed.
+		_, err := c.Write([]byte("a"))
+		So(err, ShouldNotBeNil)
+		sf.sessions.Done()
+	})
+}
+
+func TestSetCapacity(t *testing.T) {
+	Convey("SetCapacity before Start", t, func() {
+		sf := SnowflakeProxy{Capacity: 1}
+		sf.SetCapacity(2)
+		So(sf.Capacity, ShouldEqual, 2)
+	})
+	Convey("SetCapacity while running", t, func() {
+		sf := SnowflakeProxy{Capacity: 1}
+		sf.tokens = newTokens(sf.Capacity)
+		sf.tokens.Get()
+		So(sf.tokens.TryGet(), ShouldBeFalse)
+
+		sf.SetCapacity(2)
+		So(sf.getCapacity(), ShouldEqual, 2)
+		So(sf.tokens.TryGet(), ShouldBeTrue)
+
+		// Existing clients keep their tokens.
+		sf.SetCapacity(1)
+		So(sf.tokens.Count(), ShouldEqual, 2)
+		sf.tokens.Ret()
+		So(sf.tokens.TryGet(), ShouldBeFalse)
+	})
+}
+
+func TestPeriodicProxyStats(t *testing.T) {
+	Convey("Summaries are dispatched without any traffic", t, func() {
+		recorder := &eventRecorder{}
+		dispatcher := event.NewSnowflakeEventDispatcher()
+		dispatcher.AddSnowflakeEventListener(recorder)
+		natType := func() string { return NATRestricted }
+		// A zero period disables the periodic task, so ticks are manual.
+		stats := newPeriodicProxyStats(0, dispatcher, bytesNullLogger{}, natType)
+		defer stats.Close()
+
+		So(stats.logTick(), ShouldBeNil)
+		So(recorder.events, ShouldHaveLength, 1)
+		e, ok := recorder.events[0].(event.EventOnProxyStats)
+		So(ok, ShouldBeTrue)
+		So(e.ConnectionCount, ShouldEqual, 0)
+		So(e.InboundBytes, ShouldEqual, 0)
+		So(e.OutboundBytes, ShouldEqual, 0)
+		So(e.NATType, ShouldEqual, NATRestricted)
+		So(e.Uptime >= 0, ShouldBeTrue)
+	})
+}
+
+func TestExtraDataChannels(t *testing.T) {
+	Convey("Data channels besides the first one", t, func() {
+		settingsEngine := webrtc.SettingEngine{}
+		settingsEngine.SetIncludeLoopbackCandidate(true)
+		api := webrtc.NewAPI(webrtc.WithSettingEngine(settingsEngine))
+		client, err := api.NewPeerConnection(webrtc.Configuration{})
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		_, err = client.CreateDataChannel("control", nil)
+		So(err, ShouldBeNil)
+		ordered := false
+		bulk, err := client.CreateDataChannel("control-bulk", &webrtc.DataChannelInit{Ordered: &ordered})
+		So(err, ShouldBeNil)
+		bulk.OnOpen(func() { bulk.Send([]byte("bulk data")) })
+		bulkClosed := make(chan struct{})
+		bulk.OnClose(func() { close(bulkClosed) })
+		other, err := client.CreateDataChannel("other", nil)
+		So(err, ShouldBeNil)
+		otherClosed := make(chan struct{})
+		other.OnClose(func() { close(otherClosed) })
+
+		offer, err := client.CreateOffer(nil)
+		So(err, ShouldBeNil)
+		gathered := webrtc.GatheringCompletePromise(client)
+		So(client.SetLocalDescription(offer), ShouldBeNil)
+		<-gathered
+
+		sf := SnowflakeProxy{
+			KeepLocalAddresses: true,
+			EventDispatcher:    event.NewSnowflakeEventDispatcher(),
+			bytesLogger:        bytesNullLogger{},
+		}
+		dataChan := make(chan struct{})
+		conns := make(chan *webRTCConn, 2)
+		handler := func(conn *webRTCConn, _ net.Addr) { conns <- conn }
+		pc, err := sf.makePeerConnectionFromOffer("sid", clientConnection{}, client.LocalDescription(),
+			webrtc.Configuration{}, dataChan, handler)
+		So(err, ShouldBeNil)
+		defer pc.Close()
+		So(client.SetRemoteDescription(*pc.LocalDescription()), ShouldBeNil)
+
+		Convey("route the bulk channel to the connection and close the others", func() {
+			var conn *webRTCConn
+			select {
+			case conn = <-conns:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the connection")
+			}
+			received := make(chan string, 1)
+			go func() {
+				var buf [100]byte
+				n, _ := conn.Read(buf[:])
+				received <- string(buf[:n])
+			}()
+			select {
+			case p := <-received:
+				So(p, ShouldEqual, "bulk data")
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for bulk data")
+			}
+
+			select {
+			case <-otherClosed:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the other channel to be closed")
+			}
+			time.Sleep(100 * time.Millisecond)
+			So(conns, ShouldHaveLength, 0)
+			select {
+			case <-bulkClosed:
+				t.Fatal("the bulk channel was closed")
+			default:
+			}
+		})
+	})
+}
+
+// proxyRendezvous is a snowflakeClient.RendezvousMethod that answers offers
+// with a proxy peer connection, as if the broker had matched a proxy.
+type proxyRendezvous struct {
+	sf      *SnowflakeProxy
+	handler func(conn *webRTCConn, remoteAddr net.Addr)
+	pcs     []*webrtc.PeerConnection
+}
+
+func (r *proxyRendezvous) Exchange(encoded []byte) ([]byte, error) {
+	req, err := messages.DecodeClientPollRequest(encoded)
+	if err != nil {
+		return nil, err
+	}
+	offer, err := util.DeserializeSessionDescription(req.Offer)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := r.sf.makePeerConnectionFromOffer("sid", clientConnection{}, offer,
+		webrtc.Configuration{}, make(chan struct{}), r.handler)
+	if err != nil {
+		return nil, err
+	}
+	r.pcs = append(r.pcs, pc)
+	answer, err := util.SerializeSessionDescription(pc.LocalDescription())
+	if err != nil {
+		return nil, err
+	}
+	resp := &messages.ClientPollResponse{Answer: answer}
+	return resp.EncodePollResponse()
+}
+
+// hasNonLocalAddress returns whether the host has an address that a client,
+// which ignores local addresses, can gather ICE candidates on.
+func hasNonLocalAddress() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ip := ipNet.IP
+			if !util.IsLocal(ip) && !ip.IsLoopback() && !ip.IsUnspecified() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestDualDataChannelsClient(t *testing.T) {
+	if !hasNonLocalAddress() {
+		t.Skip("no non-local address for the client to gather ICE candidates on")
+	}
+	Convey("A client with dual data channels", t, func() {
+		conns := make(chan *webRTCConn, 2)
+		rendezvous := &proxyRendezvous{
+			sf: &SnowflakeProxy{
+				KeepLocalAddresses: true,
+				EventDispatcher:    event.NewSnowflakeEventDispatcher(),
+				bytesLogger:        bytesNullLogger{},
+			},
+			handler: func(conn *webRTCConn, _ net.Addr) { conns <- conn },
+		}
+		defer func() {
+			for _, pc := range rendezvous.pcs {
+				pc.Close()
+			}
+		}()
+
+		peer, err := snowflakeClient.NewWebRTCPeerWithOptions(&webrtc.Configuration{},
+			&snowflakeClient.BrokerChannel{Rendezvous: rendezvous},
+			snowflakeClient.WebRTCPeerOptions{DualDataChannels: true})
+		So(err, ShouldBeNil)
+		defer peer.Close()
+		var conn *webRTCConn
+		select {
+		case conn = <-conns:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the connection")
+		}
+
+		Convey("relays traffic on both channels through the proxy", func() {
+			So(peer.SetWriteChannel(snowflakeClient.DataChannelBulk), ShouldBeNil)
+			_, err := peer.Write([]byte("bulk data"))
+			So(err, ShouldBeNil)
+			received := make(chan string, 1)
+			go func() {
+				var buf [100]byte
+				n, _ := conn.Read(buf[:])
+				received <- string(buf[:n])
+			}()
+			select {
+			case p := <-received:
+				So(p, ShouldEqual, "bulk data")
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for bulk data")
+			}
+
+			_, err = conn.Write([]byte("reply"))
+			So(err, ShouldBeNil)
+			go func() {
+				var buf [100]byte
+				n, _ := peer.Read(buf[:])
+				received <- string(buf[:n])
+			}()
+			select {
+			case p := <-received:
+				So(p, ShouldEqual, "reply")
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the reply")
+			}
+			So(peer.Closed(), ShouldBeFalse)
+			So(conns, ShouldHaveLength, 0)
+		})
+	})
+}
+
+func TestNATProbeTransport(t *testing.T) {
+	Convey("The NAT probe", t, func() {
+		Convey("sends its offer with BrokerTransport", func() {
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusInternalServerError, nil}}
+			sf := SnowflakeProxy{BrokerTransport: transport}
+			err := sf.probeNATType(webrtc.Configuration{}, "https://probe.example/probe")
+			So(err, ShouldNotBeNil)
+			So(transport.requests("/probe"), ShouldEqual, 1)
+		})
+		Convey("logs through the proxy's Logger", func() {
+			var buf bytes.Buffer
+			sf := SnowflakeProxy{
+				Logger:          slog.New(slog.NewJSONHandler(&buf, nil)),
+				BrokerTransport: &MockTransport{http.StatusInternalServerError, nil},
+			}
+			err := sf.probeNATType(webrtc.Configuration{}, "https://probe.example/probe")
+			So(err, ShouldNotBeNil)
+			So(buf.String(), ShouldContainSubstring, `"status_code":500`)
+		})
+		Convey("goes through the outbound proxy otherwise", func() {
+			proxyURL, err := url.Parse("socks5://127.0.0.1:1080")
+			So(err, ShouldBeNil)
+			sf := SnowflakeProxy{outboundProxy: proxyURL}
+			transport, ok := sf.brokerTransport().(*http.Transport)
+			So(ok, ShouldBeTrue)
+			req, err := http.NewRequest(http.MethodPost, "https://probe.example/probe", nil)
+			So(err, ShouldBeNil)
+			used, err := transport.Proxy(req)
+			So(err, ShouldBeNil)
+			So(used, ShouldResemble, proxyURL)
+		})
+	})
+}
+
+// gatheringListener passes on the EventOnICEGatheringComplete events it
+// receives.
+type gatheringListener chan event.EventOnICEGatheringComplete
+
+func (l gatheringListener) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	if e, ok := e.(event.EventOnICEGatheringComplete); ok {
+		l <- e
+	}
+}
+
+func TestTrickleICEGathering(t *testing.T) {
+	Convey("A proxy that trickles ICE", t, func() {
+		client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		So(err, ShouldBeNil)
+		defer client.Close()
+		_, err = client.CreateDataChannel("control", nil)
+		So(err, ShouldBeNil)
+		offer, err := client.CreateOffer(nil)
+		So(err, ShouldBeNil)
+		gathered := webrtc.GatheringCompletePromise(client)
+		So(client.SetLocalDescription(offer), ShouldBeNil)
+		<-gathered
+
+		listener := make(gatheringListener, 1)
+		sf := SnowflakeProxy{
+			TrickleICE:      true,
+			EventDispatcher: event.NewSnowflakeEventDispatcher(),
+		}
+		sf.EventDispatcher.AddSnowflakeEventListener(listener)
+		pc, err := sf.makePeerConnectionFromOffer("sid", clientConnection{}, client.LocalDescription(),
+			webrtc.Configuration{}, make(chan struct{}), func(*webRTCConn, net.Addr) {})
+		So(err, ShouldBeNil)
+		defer pc.Close()
+
+		Convey("reports gathering once it is complete", func() {
+			select {
+			case e := <-listener:
+				So(e.SessionID, ShouldEqual, "sid")
+				So(e.TimedOut, ShouldBeFalse)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for EventOnICEGatheringComplete")
+			}
+		})
+	})
+}
+
+func TestWebRTCConnWrite(t *testing.T) {
+	Convey("Writes that are not sent are not counted", t, func() {
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		So(err, ShouldBeNil)
+		// The data channel never opens, so sending on it fails.
+		dc, err := pc.CreateDataChannel("test", nil)
+		So(err, ShouldBeNil)
+		pr, _ := io.Pipe()
+		conn := newWebRTCConn(pc, dc, pr, bytesNullLogger{}, defaultLogMsg)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello"))
+		So(err, ShouldBeNil)
+		inbound, _ := conn.GetStat()
+		So(inbound, ShouldEqual, 0)
+	})
 }
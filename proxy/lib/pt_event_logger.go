@@ -40,17 +40,26 @@ func (p *proxyEventLogger) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
 }
 
 type periodicProxyStats struct {
-	bytesLogger     bytesLogger
+	bytesLogger     BytesLogger
 	connectionCount int
 	logPeriod       time.Duration
 	task            *task.Periodic
 	dispatcher      event.SnowflakeEventDispatcher
+	// start is when the proxy started, and natType returns its current NAT
+	// type, both reported in every summary.
+	start   time.Time
+	natType func() string
 }
 
-func newPeriodicProxyStats(logPeriod time.Duration, dispatcher event.SnowflakeEventDispatcher, bytesLogger bytesLogger) *periodicProxyStats {
-	el := &periodicProxyStats{logPeriod: logPeriod, dispatcher: dispatcher, bytesLogger: bytesLogger}
+// newPeriodicProxyStats dispatches an EventOnProxyStats every logPeriod, even
+// if nothing was relayed, so that the summaries also show that the proxy is
+// alive. A logPeriod of 0 disables the summaries.
+func newPeriodicProxyStats(logPeriod time.Duration, dispatcher event.SnowflakeEventDispatcher, bytesLogger BytesLogger, natType func() string) *periodicProxyStats {
+	el := &periodicProxyStats{logPeriod: logPeriod, dispatcher: dispatcher, bytesLogger: bytesLogger, start: time.Now(), natType: natType}
 	el.task = &task.Periodic{Interval: logPeriod, Execute: el.logTick}
-	el.task.WaitThenStart()
+	if logPeriod > 0 {
+		el.task.WaitThenStart()
+	}
 	return el
 }
 
@@ -66,9 +75,12 @@ func (p *periodicProxyStats) logTick() error {
 	e := event.EventOnProxyStats{
 		SummaryInterval: p.logPeriod,
 		ConnectionCount: p.connectionCount,
+		Uptime:          time.Since(p.start),
+		NATType:         p.natType(),
 	}
-	e.InboundBytes, e.InboundUnit = formatTraffic(inboundSum)
-	e.OutboundBytes, e.OutboundUnit = formatTraffic(outboundSum)
+	// A BytesLogger that does not count traffic reports negative amounts.
+	e.InboundBytes, e.InboundUnit = formatTraffic(max(inboundSum, 0))
+	e.OutboundBytes, e.OutboundUnit = formatTraffic(max(outboundSum, 0))
 	p.dispatcher.OnNewSnowflakeEvent(e)
 	p.connectionCount = 0
 	return nil
@@ -8,6 +8,10 @@ type EventCollector interface {
 	TrackInBoundTraffic(value int64)
 	TrackOutBoundTraffic(value int64)
 	TrackNewConnection()
+	TrackClientConnected()
+	TrackClientDisconnected()
+	TrackPollFailure()
+	TrackNATType(natType string)
 }
 
 type EventMetrics struct {
@@ -24,7 +28,15 @@ func (em *EventMetrics) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
 		e := e.(event.EventOnProxyStats)
 		em.collector.TrackInBoundTraffic(e.InboundBytes)
 		em.collector.TrackOutBoundTraffic(e.OutboundBytes)
+	case event.EventOnProxyClientConnected:
+		em.collector.TrackClientConnected()
 	case event.EventOnProxyConnectionOver:
 		em.collector.TrackNewConnection()
+		em.collector.TrackClientDisconnected()
+	case event.EventOnProxyPollFailed:
+		em.collector.TrackPollFailure()
+	case *event.EventOnCurrentNATTypeDetermined:
+		e := e.(*event.EventOnCurrentNATTypeDetermined)
+		em.collector.TrackNATType(e.CurNATType)
 	}
 }
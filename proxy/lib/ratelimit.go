@@ -0,0 +1,59 @@
+package snowflake_proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that lets through bytesPerSecond bytes per
+// second on average, with bursts of up to one second's worth of bytes.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n more bytes may be sent. Callers that transfer more than
+// the bucket holds go into debt, which later callers wait out.
+func (l *rateLimiter) wait(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	time.Sleep(delay)
+}
+
+// rateLimitedConn throttles reads from the wrapped connection, and thereby
+// everything that copyLoop copies out of it, with each of its limiters.
+type rateLimitedConn struct {
+	io.ReadWriteCloser
+	limiters []*rateLimiter
+}
+
+func newRateLimitedConn(conn io.ReadWriteCloser, limiters ...*rateLimiter) *rateLimitedConn {
+	return &rateLimitedConn{ReadWriteCloser: conn, limiters: limiters}
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	for _, limiter := range c.limiters {
+		limiter.wait(n)
+	}
+	return n, err
+}
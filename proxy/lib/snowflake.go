@@ -22,22 +22,29 @@ the proxy will not poll for more clients.
 	// ...
 
 	proxy.Stop()
+
+To let existing connections finish before shutting down, use Drain instead of Stop.
 */
 package snowflake_proxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/pion/ice/v4"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -55,13 +62,20 @@ import (
 )
 
 const (
-	DefaultPollInterval = 5 * time.Second
-	DefaultBrokerURL    = "https://snowflake-broker.torproject.net/"
-	DefaultNATProbeURL  = "https://snowflake-broker.torproject.net:8443/probe"
+	DefaultPollInterval   = 5 * time.Second
+	DefaultMaxPollBackoff = 5 * time.Minute
+	DefaultBrokerURL      = "https://snowflake-broker.torproject.net/"
+	DefaultNATProbeURL    = "https://snowflake-broker.torproject.net:8443/probe"
 	// This is rather a "DefaultDefaultRelayURL"
 	DefaultRelayURL  = "wss://snowflake.torproject.net/"
 	DefaultSTUNURL   = "stun:stun.l.google.com:19302,stun:stun.voip.blackberry.com:3478"
 	DefaultProxyType = "standalone"
+	// DefaultRelayDomainNamePattern is the relay domain name pattern of the
+	// standalone proxy.
+	DefaultRelayDomainNamePattern = "snowflake.torproject.net$"
+	// DefaultProbeDataChannelLabel is the label of the data channel opened
+	// when testing the proxy's NAT type.
+	DefaultProbeDataChannelLabel = "test"
 )
 
 const (
@@ -80,61 +94,137 @@ const (
 	// client is not going to connect
 	dataChannelTimeout = 20 * time.Second
 
-	// Maximum number of bytes to be read from an HTTP request
+	// Default maximum number of bytes to be read from an HTTP response
 	readLimit = 100000
 
 	sessionIDLength = 16
-)
-
-const bufferedAmountLowThreshold uint64 = 256 * 1024 // 256 KB
 
-var broker *SignalingServer
+	// answerRetries is the number of times a failed answer is sent again to
+	// the broker, waiting answerRetryDelay before the first retry and twice
+	// as long before each following one.
+	answerRetries    = 2
+	answerRetryDelay = 250 * time.Millisecond
 
-var currentNATTypeAccess = &sync.RWMutex{}
+	// trickleBufferSize is the number of ICE candidates that may be
+	// gathered before they are read, when trickling ICE.
+	trickleBufferSize = 32
 
-// currentNATType describes local network environment.
-// Obtain currentNATTypeAccess before access.
-var currentNATType = NATUnknown
+	// unixRelayScheme is the URL scheme of relays on a unix domain socket.
+	unixRelayScheme = "ws+unix"
 
-func getCurrentNATType() string {
-	currentNATTypeAccess.RLock()
-	defer currentNATTypeAccess.RUnlock()
-	return currentNATType
-}
+	// asymmetricTrafficMinBytes is the number of bytes a connection must
+	// have relayed in one direction to be checked against
+	// AsymmetricTrafficRatio.
+	asymmetricTrafficMinBytes = 1000 * 1000
+)
 
-func setCurrentNATType(newType string) {
-	currentNATTypeAccess.Lock()
-	defer currentNATTypeAccess.Unlock()
-	currentNATType = newType
-}
+// DefaultBufferedAmountLowThreshold is the default value of
+// SnowflakeProxy.BufferedAmountLowThreshold.
+const DefaultBufferedAmountLowThreshold uint64 = 256 * 1024 // 256 KB
 
-var (
-	tokens *tokens_t
-	config webrtc.Configuration
-	client http.Client
-)
+// DefaultMaxOfferSize is the default value of SnowflakeProxy.MaxOfferSize.
+const DefaultMaxOfferSize = 16 * 1024 // 16 KB
 
 // SnowflakeProxy is used to configure an embedded
 // Snowflake in another Go application.
 // For some more info also see CLI parameter descriptions in README.
 type SnowflakeProxy struct {
-	// How often to ask the broker for a new client
+	// How often to ask the broker for a new client.
+	// If zero, DefaultPollInterval is used.
 	PollInterval time.Duration
+	// MaxPollBackoff is the longest time to wait between polls after
+	// consecutive failures to reach the broker. The wait grows exponentially
+	// from PollInterval. If zero, DefaultMaxPollBackoff is used; setting it to
+	// PollInterval disables the backoff. It does not cap the delay that the
+	// broker asks for with Retry-After when it rate limits the proxy.
+	MaxPollBackoff time.Duration
 	// Capacity is the maximum number of clients a Snowflake will serve.
 	// Proxies with a capacity of 0 will accept an unlimited number of clients.
 	Capacity uint
+	// TokenPool, if set, limits the clients served at once instead of
+	// Capacity, for example to change the limit depending on the load of the
+	// host. Capacity is then only used in events.
+	TokenPool TokenPool
+	// RelayCapacity is the maximum number of clients a Snowflake will serve
+	// for each of the given relay URLs, within the overall Capacity.
+	// Clients of other relays are only limited by Capacity.
+	RelayCapacity map[string]uint
 	// STUNURL is the URLs (comma-separated) of the STUN server the proxy will use
 	STUNURL string
+	// STUNURLs is a list of STUN server URLs the proxy will use, each as a
+	// separate ICE server. If non-empty, it takes precedence over STUNURL.
+	STUNURLs []string
+	// TURNURLs is a list of TURN server URLs the proxy will use to gather
+	// relayed candidates, authenticating with TURNUsername and TURNCredential.
+	// This allows proxies behind restrictive NATs to still serve clients.
+	TURNURLs       []string
+	TURNUsername   string
+	TURNCredential string
+	// Certificate, if set, is the DTLS certificate used for all peer
+	// connections, giving the proxy a stable DTLS fingerprint. If nil, a new
+	// certificate is generated for every peer connection.
+	Certificate *webrtc.Certificate
 	// BrokerURL is the URL of the Snowflake broker
 	BrokerURL string
+	// BrokerTransport is used to send requests to the broker and to the NAT
+	// probe server. If nil, a copy of http.DefaultTransport is used.
+	BrokerTransport http.RoundTripper
+	// OutboundProxyURL, if set, is the URL of a socks5:// or http:// proxy
+	// through which requests to the broker and the NAT probe server, and
+	// connections to the relay, are made. It is ignored for broker and NAT
+	// probe requests if BrokerTransport is set.
+	OutboundProxyURL string
+	// BrokerResponseLimit is the maximum size in bytes of a response from the
+	// broker. Larger responses are rejected with ErrResponseTooLarge.
+	// If zero, a default of 100000 bytes is used.
+	BrokerResponseLimit int64
+	// TrickleICE makes the proxy send its answer to the broker as soon as
+	// it has gathered a host candidate, instead of waiting for all
+	// candidates. The in-tree broker and client do not support trickle ICE
+	// yet: the candidates gathered after the answer are not sent, and the
+	// broker rejects an answer that has no candidate, which happens if no
+	// host candidate is gathered before the client would time out.
+	TrickleICE bool
 	// KeepLocalAddresses indicates whether local SDP candidates will be sent to the broker
 	KeepLocalAddresses bool
+	// FilterCandidate, if set, is called for each ICE candidate that would be
+	// sent to the broker, in the form of an SDP a=candidate: line without
+	// the "a=" prefix. Candidates for which it returns false are not sent.
+	FilterCandidate func(candidate string) bool
 	// RelayURL is the default `URL` of the server (relay)
 	// that this proxy will forward client connections to,
 	// in case the broker itself did not specify the said URL
 	RelayURL string
+	// RelayHostOverride and RelaySNIOverride, if set, replace the Host
+	// header and the TLS server name sent when connecting to the relay, for
+	// example to reach it through a domain front. They only apply to wss://
+	// relays; connections to other relays fail if either is set.
+	RelayHostOverride string
+	RelaySNIOverride  string
+	// RelayHeaders are extra header fields sent in the WebSocket handshake
+	// with the relay, for example an Authorization token for a private
+	// relay. Header fields that are part of the WebSocket handshake itself
+	// are not allowed. RelayHostOverride, if set, takes precedence over a
+	// Host field.
+	RelayHeaders http.Header
+	// ClientIPMode controls how the client's IP address is passed to the
+	// relay in the client_ip query parameter: ClientIPFull (the default),
+	// ClientIPTruncated or ClientIPNone.
+	ClientIPMode ClientIPMode
+	// EnableRelayCompression makes the proxy offer permessage-deflate
+	// compression when connecting to the relay. It is off by default,
+	// because Tor traffic is encrypted and does not compress.
+	EnableRelayCompression bool
+	// ForceRelayURL makes the proxy always forward client connections to
+	// RelayURL, ignoring any relay URL supplied by the broker. RelayURL must
+	// then match one of the relay domain name patterns.
+	ForceRelayURL bool
 	// OutboundAddress specify an IP address to use as SDP host candidate
 	OutboundAddress string
+	// OutboundAddresses specify IP addresses to use as SDP host candidates,
+	// e.g. one IPv4 and one IPv6 address on a dual-stack host.
+	// They are used in addition to OutboundAddress.
+	OutboundAddresses []string
 	// EphemeralMinPort and EphemeralMaxPort limit the range of ports that
 	// ICE UDP connections may allocate from.
 	EphemeralMinPort uint16
@@ -145,26 +235,183 @@ type SnowflakeProxy struct {
 	// There is no look ahead assertion when matching domain name suffix,
 	// thus the string prepend the suffix does not need to be empty or ends with a dot.
 	RelayDomainNamePattern string
+	// RelayDomainNamePatterns are more patterns like RelayDomainNamePattern.
+	// A relay is allowed if its domain name matches any of the patterns.
+	// The broker only supports a single pattern, so only the first one,
+	// starting with RelayDomainNamePattern if it is set, is sent to it.
+	RelayDomainNamePatterns []string
 	// AllowProxyingToPrivateAddresses determines whether to allow forwarding
 	// client connections to private IP addresses.
 	// Useful when a Snowflake server (relay) is hosted on the same private network
 	// as this proxy.
 	AllowProxyingToPrivateAddresses bool
 	AllowNonTLSRelay                bool
+	// AllowUnixRelay determines whether the broker may direct client
+	// connections to a relay on a unix domain socket, given as a
+	// ws+unix:///path/to/socket URL. RelayURL itself may always be such a URL.
+	AllowUnixRelay bool
 	// NATProbeURL is the URL of the probe service we use for NAT checks
 	NATProbeURL string
 	// NATTypeMeasurementInterval is time before NAT type is retested
 	NATTypeMeasurementInterval time.Duration
+	// DisableNATProbe skips the initial NAT type check and the periodic
+	// retests, so that the proxy's NAT type stays NATUnknown.
+	DisableNATProbe bool
+	// ServeClientNATTypes lists the client NAT types (NATUnknown, NATRestricted,
+	// NATUnrestricted) whose offers the proxy will accept. The list is sent to
+	// the broker in polls, and offers from other clients that the broker
+	// matches anyway are dropped. If empty, all clients are served.
+	ServeClientNATTypes []string
+	// AcceptConnection, if set, is called with the client's address (which may
+	// be nil) before relaying a new connection. If it returns false, the
+	// connection is closed without contacting the relay.
+	AcceptConnection func(remoteAddr net.Addr) bool
+	// MaxConnectionsPerIP, if non-zero, is the maximum number of connections
+	// relayed at once for clients with the same IP address. Further
+	// connections from that address are closed without contacting the relay.
+	// Clients whose address is unknown are not limited.
+	MaxConnectionsPerIP uint
+	// ClientConnectionTimeout is the amount of time after sending an SDP answer
+	// that the proxy waits for the client to open the data channel.
+	// If zero, a default of 20 seconds is used.
+	ClientConnectionTimeout time.Duration
+	// MaxConnectionDuration, if non-zero, is the longest time a client
+	// connection is relayed before the proxy closes it, regardless of activity.
+	MaxConnectionDuration time.Duration
+	// RelayWriteTimeout, if non-zero, is the longest time a write to the
+	// relay may take. A client connection is closed when a write to its relay
+	// times out, for example because the relay connection is half-open.
+	RelayWriteTimeout time.Duration
+	// AsymmetricTrafficRatio, if non-zero, makes the proxy log a warning when
+	// a client connection is over in which at least 1 MB went in one
+	// direction, and more than AsymmetricTrafficRatio times as many bytes
+	// as in the other direction. Such one-sided traffic may be a sign of
+	// misuse.
+	AsymmetricTrafficRatio float64
+	// PerConnectionRateLimit, if non-zero, limits the bytes per second relayed
+	// in each direction of every client connection.
+	PerConnectionRateLimit int64
+	// TotalRateLimit, if non-zero, limits the bytes per second relayed across
+	// all client connections, in both directions combined. Connections are
+	// slowed down, not closed, when the limit is reached.
+	TotalRateLimit int64
+	// BufferedAmountLowThreshold is the number of bytes buffered in a client's
+	// data channel at or below which writes to it resume after having been
+	// paused because too much data was buffered. It must be lower than
+	// 512 KB, the buffered amount at which writes pause. If zero,
+	// DefaultBufferedAmountLowThreshold is used.
+	BufferedAmountLowThreshold uint64
+	// MaxOfferSize is the size in bytes of the largest client SDP offer the
+	// proxy accepts from the broker. Larger offers are rejected before they
+	// are parsed by WebRTC. If zero, DefaultMaxOfferSize is used.
+	MaxOfferSize uint
+	// BandwidthClass, if not empty, is advertised to the broker in every poll
+	// as a hint about how much bandwidth the proxy can offer, for example
+	// "high". Brokers that do not support it ignore it.
+	BandwidthClass string
 	// ProxyType is the type reported to the broker, if not provided it "standalone" will be used
 	ProxyType       string
 	EventDispatcher event.SnowflakeEventDispatcher
 	shutdown        chan struct{}
 
+	// Logger, if set, receives the proxy's log messages about sessions,
+	// connections and NAT type measurements, along with structured attributes
+	// such as session_id, relay_url and nat_type. If nil, messages are written
+	// with the standard log package.
+	Logger *slog.Logger
+
+	// ProbeDataChannelLabel is the label of the data channel opened when
+	// testing the proxy's NAT type. If empty, "test" is used.
+	ProbeDataChannelLabel string
+
 	// SummaryInterval is the time interval at which proxy stats will be logged
 	SummaryInterval time.Duration
 
+	// BytesLogger receives the traffic relayed by the proxy. It is also
+	// queried for the periodic stats summary. If nil, a default
+	// implementation that only feeds the summary is used.
+	BytesLogger BytesLogger
+
+	// SessionIDGenerator, if set, returns the identifiers of new sessions
+	// with the broker and clients, for example to correlate them with
+	// external logs. If nil, random identifiers are used.
+	SessionIDGenerator func() string
+
+	// MetricsListenAddr is the address on which Prometheus metrics will be
+	// served, under the path /internal/metrics. If empty, no metrics are served.
+	MetricsListenAddr string
+
+	// HealthListenAddr is the address on which a health check will be
+	// served, under the path /health. It returns 200 once the proxy has
+	// determined its NAT type and its last poll to the broker succeeded, and
+	// 503 otherwise. If empty, no health check is served.
+	HealthListenAddr string
+
+	// StatusListenAddr is the address on which the live status of the proxy
+	// will be served as JSON, under the path /status: its NAT type, active
+	// sessions and connections, total traffic, uptime, and the time of the
+	// last successful poll to the broker. If empty, no status is served.
+	StatusListenAddr string
+
 	periodicProxyStats *periodicProxyStats
-	bytesLogger        bytesLogger
+	// bytesLogger receives the traffic of client connections. It is
+	// BytesLogger, or the status server passing the traffic on to it.
+	bytesLogger BytesLogger
+
+	// pollShutdown is closed to stop polling the broker for new clients,
+	// without closing existing connections.
+	pollShutdown chan struct{}
+	// pollDone is closed when the poll loop in Start has exited.
+	pollDone chan struct{}
+	// state holds the proxy's State.
+	state atomic.Int32
+	// runLock protects shutdown, pollShutdown and pollDone, which Start
+	// replaces when it is called again after the proxy stopped.
+	runLock sync.Mutex
+	// broker is the signaling server of the broker, set up by Start.
+	broker *SignalingServer
+	// tokens limits the number of clients served at once.
+	tokens TokenPool
+	// capacityLock protects Capacity and tokens from SetCapacity.
+	capacityLock sync.Mutex
+	// config is the WebRTC configuration of client peer connections.
+	config webrtc.Configuration
+
+	// natTypeLock protects natType.
+	natTypeLock sync.RWMutex
+	// natType describes the local network environment. Empty means
+	// NATUnknown.
+	natType string
+	// sessions counts the sessions that hold a token.
+	sessions sync.WaitGroup
+	// pollFailures is the number of consecutive failed polls to the broker.
+	// It is only accessed from the poll loop.
+	pollFailures int
+	// pollRetryAfter is the delay the broker asked for before the next poll,
+	// when it rate limited the last one. It is only accessed from the poll
+	// loop.
+	pollRetryAfter time.Duration
+	// outboundProxy is the parsed OutboundProxyURL, or nil.
+	outboundProxy *url.URL
+	// activeOffers holds the client offers being answered, so that an offer
+	// the broker hands out twice is not answered twice at the same time.
+	activeOffers offerSet
+	// activeConns holds the connections of the sessions in progress, for
+	// StopWithTimeout to close.
+	activeConns connSet
+	// relayTokens limits the clients of relays listed in RelayCapacity.
+	relayTokens relayTokens
+	// ipConnections counts the connections of each client IP address, to
+	// enforce MaxConnectionsPerIP.
+	ipConnections ipConnections
+	// natProbeResults holds the results of the recent NAT type probes.
+	natProbeResults natProbeResults
+	// clock is the source of time of the poll loop and of sessions. If nil,
+	// the time package is used.
+	clock Clock
+
+	// totalRateLimiter is shared by all connections if TotalRateLimit is set.
+	totalRateLimiter *rateLimiter
 }
 
 // Checks whether an IP address is a remote address for the client
@@ -172,32 +419,120 @@ func isRemoteAddress(ip net.IP) bool {
 	return !(util.IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback())
 }
 
-func genSessionID() string {
+// genSessionID returns a random session identifier. It is the default
+// SessionIDGenerator.
+func genSessionID() (string, error) {
 	buf := make([]byte, sessionIDLength)
 	_, err := rand.Read(buf)
 	if err != nil {
-		panic(err.Error())
+		return "", err
+	}
+	return strings.TrimRight(base64.StdEncoding.EncodeToString(buf), "="), nil
+}
+
+// newSessionID returns an identifier for a new session, from
+// SessionIDGenerator if set.
+func (sf *SnowflakeProxy) newSessionID() (string, error) {
+	if sf.SessionIDGenerator != nil {
+		return sf.SessionIDGenerator(), nil
+	}
+	return genSessionID()
+}
+
+// genRequestID returns a random identifier for a request to the broker.
+func genRequestID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
 	}
-	return strings.TrimRight(base64.StdEncoding.EncodeToString(buf), "=")
+	return hex.EncodeToString(buf), nil
+}
+
+// sessionHeader returns the header fields that identify the session sid in
+// requests to the broker.
+func sessionHeader(sid string) http.Header {
+	header := make(http.Header)
+	header.Set("X-Session-ID", sid)
+	return header
 }
 
+// ErrResponseTooLarge is returned when a response from the broker is larger
+// than the configured limit, and was therefore truncated.
+var ErrResponseTooLarge = errors.New("response too large")
+
 func limitedRead(r io.Reader, limit int64) ([]byte, error) {
 	p, err := io.ReadAll(&io.LimitedReader{R: r, N: limit + 1})
 	if err != nil {
 		return p, err
 	} else if int64(len(p)) == limit+1 {
-		return p[0:limit], io.ErrUnexpectedEOF
+		return p[0:limit], ErrResponseTooLarge
 	}
 	return p, err
 }
 
+// statusCodeError is returned by SignalingServer.Post when the broker responds
+// with a status code other than 200 OK.
+type statusCodeError int
+
+func (e statusCodeError) Error() string {
+	return fmt.Sprintf("remote returned status code %d", int(e))
+}
+
+// rateLimitError is returned by SignalingServer.Post when the broker responds
+// with 429 Too Many Requests. retryAfter is the delay the broker asked for in
+// its Retry-After header, or zero if it did not.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e rateLimitError) Error() string {
+	if e.retryAfter == 0 {
+		return statusCodeError(http.StatusTooManyRequests).Error()
+	}
+	return fmt.Sprintf("%s, retry after %v", statusCodeError(http.StatusTooManyRequests), e.retryAfter)
+}
+
+func (e rateLimitError) Unwrap() error {
+	return statusCodeError(http.StatusTooManyRequests)
+}
+
+// isRetryable reports whether a request to the broker that failed with err
+// may succeed if sent again: that is, if it failed in transit or because of a
+// server error.
+func isRetryable(err error) bool {
+	var statusErr statusCodeError
+	if errors.As(err, &statusErr) {
+		return statusErr >= 500
+	}
+	return !errors.Is(err, ErrResponseTooLarge)
+}
+
 // SignalingServer keeps track of the SignalingServer in use by the Snowflake
 type SignalingServer struct {
 	url       *url.URL
 	transport http.RoundTripper
+	// readLimit is the maximum number of bytes read from a response.
+	readLimit int64
+	// filterCandidate, if set, decides which ICE candidates are sent.
+	filterCandidate func(candidate string) bool
+	// bandwidthClass, if not empty, is advertised to the broker in polls.
+	bandwidthClass string
+	// clientNATTypes, if not empty, are the client NAT types that polls ask
+	// the broker to match.
+	clientNATTypes []string
+	// logMsg logs the server's messages.
+	logMsg logFunc
+	// clock times the waits between answer retries, which are cut short
+	// when shutdown is closed.
+	clock    Clock
+	shutdown chan struct{}
 }
 
-func newSignalingServer(rawURL string) (*SignalingServer, error) {
+// newSignalingServer returns a SignalingServer for rawURL that sends its
+// requests with transport. If transport is nil, a copy of
+// http.DefaultTransport is used.
+func newSignalingServer(rawURL string, transport http.RoundTripper) (*SignalingServer, error) {
 	var err error
 	s := new(SignalingServer)
 	s.url, err = url.Parse(rawURL)
@@ -205,70 +540,125 @@ func newSignalingServer(rawURL string) (*SignalingServer, error) {
 		return nil, fmt.Errorf("invalid broker url: %s", err)
 	}
 
-	s.transport = http.DefaultTransport.(*http.Transport)
-	s.transport.(*http.Transport).ResponseHeaderTimeout = 30 * time.Second
+	if transport == nil {
+		transport = newBrokerTransport(nil)
+	}
+	s.transport = transport
+	s.readLimit = readLimit
+	s.logMsg = defaultLogMsg
+	s.clock = realClock{}
 
 	return s, nil
 }
 
-// Post sends a POST request to the SignalingServer
-func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
+// brokerTransport returns the transport for requests to the broker and to the
+// NAT probe server: BrokerTransport if set, otherwise one that goes through the
+// outbound proxy, if any.
+func (sf *SnowflakeProxy) brokerTransport() http.RoundTripper {
+	if sf.BrokerTransport != nil {
+		return sf.BrokerTransport
+	}
+	return newBrokerTransport(sf.outboundProxy)
+}
+
+// newBrokerTransport returns the transport used for broker requests when none
+// is configured, going through proxyURL if it is not nil.
+func newBrokerTransport(proxyURL *url.URL) *http.Transport {
+	// Clone rather than modify http.DefaultTransport, which may be
+	// shared with the rest of the application.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport
+}
+
+// Post sends a POST request to the SignalingServer, with the given extra
+// header fields, which may be nil. Each request is tagged with a random
+// X-Request-ID, which is logged along with any error to help correlate the
+// request with the broker's logs.
+func (s *SignalingServer) Post(path string, payload io.Reader, header http.Header) ([]byte, error) {
 	req, err := http.NewRequest("POST", path, payload)
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	requestID, err := genRequestID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating request ID: %w", err)
+	}
+	req.Header.Set("X-Request-ID", requestID)
+	logMsg := s.logMsg.with(slog.String("session_id", header.Get("X-Session-ID")), slog.String("request_id", requestID))
+	logMsg(slog.LevelDebug, fmt.Sprintf("sending request %s to %s", requestID, path))
 
 	resp, err := s.transport.RoundTrip(req)
 	if err != nil {
+		logMsg(slog.LevelError, fmt.Sprintf("request %s failed: %v", requestID, err))
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("remote returned status code %d", resp.StatusCode)
+		logMsg(slog.LevelError, fmt.Sprintf("request %s failed: remote returned status code %d", requestID, resp.StatusCode),
+			slog.Int("status_code", resp.StatusCode))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, rateLimitError{parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+		}
+		return nil, statusCodeError(resp.StatusCode)
 	}
 
 	defer resp.Body.Close()
-	return limitedRead(resp.Body, readLimit)
+	return limitedRead(resp.Body, s.readLimit)
 }
 
 // pollOffer communicates the proxy's capabilities with broker
-// and retrieves a compatible SDP offer and relay URL.
-func (s *SignalingServer) pollOffer(sid string, proxyType string, acceptedRelayPattern string) (*webrtc.SessionDescription, string) {
+// and retrieves a compatible SDP offer, the client's NAT type and relay URL.
+// If the broker has no client for us, the returned offer is nil.
+// natType is the proxy's NAT type, and clients the number of clients currently
+// served.
+func (s *SignalingServer) pollOffer(sid string, proxyType string, natType string, acceptedRelayPattern string, clients int64) (
+	offer *webrtc.SessionDescription, clientNATType string, relayURL string, err error,
+) {
 	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy"})
 
-	numClients := int((tokens.count() / 8) * 8) // Round down to 8
-	currentNATTypeLoaded := getCurrentNATType()
-	body, err := messages.EncodeProxyPollRequestWithRelayPrefix(sid, proxyType, currentNATTypeLoaded, numClients, acceptedRelayPattern)
+	numClients := int((clients / 8) * 8) // Round down to 8
+	body, err := messages.EncodeProxyPollRequestWithClientNATTypes(sid, proxyType, natType, numClients, acceptedRelayPattern, s.bandwidthClass, s.clientNATTypes)
 	if err != nil {
-		log.Printf("Error encoding poll message: %s", err.Error())
-		return nil, ""
+		return nil, "", "", fmt.Errorf("error encoding poll message: %s", err.Error())
 	}
 
-	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
+	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body), sessionHeader(sid))
 	if err != nil {
-		log.Printf("error polling broker: %s", err.Error())
+		return nil, "", "", fmt.Errorf("error polling broker: %w", err)
 	}
 
-	offer, _, relayURL, err := messages.DecodePollResponseWithRelayURL(resp)
+	offerSDP, clientNATType, relayURL, err := messages.DecodePollResponseWithRelayURL(resp)
 	if err != nil {
-		log.Printf("Error reading broker response: %s", err.Error())
-		log.Printf("body: %s", resp)
-		return nil, ""
+		s.logMsg(slog.LevelError, fmt.Sprintf("body: %s", resp), slog.String("session_id", sid))
+		return nil, "", "", fmt.Errorf("error reading broker response: %s", err.Error())
 	}
-	if offer != "" {
-		offer, err := util.DeserializeSessionDescription(offer)
+	if offerSDP != "" {
+		offer, err := util.DeserializeSessionDescription(offerSDP)
 		if err != nil {
-			log.Printf("Error processing session description: %s", err.Error())
-			return nil, ""
+			return nil, "", "", fmt.Errorf("error processing session description: %s", err.Error())
 		}
-		return offer, relayURL
+		return offer, clientNATType, relayURL, nil
 	}
-	return nil, ""
+	return nil, "", "", nil
 }
 
 // sendAnswer encodes an SDP answer, sends it to the broker
 // and wait for its response
 func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) error {
 	ld := pc.LocalDescription()
+	if s.filterCandidate != nil {
+		ld = &webrtc.SessionDescription{
+			Type: ld.Type,
+			SDP:  filterCandidates(ld.SDP, s.filterCandidate),
+		}
+	}
 	answer, err := util.SerializeSessionDescription(ld)
 	if err != nil {
 		return err
@@ -279,8 +669,25 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 		return err
 	}
 
+	// Retry a few times on transient errors, rather than waste the
+	// connection attempt. The client gives up waiting for the answer
+	// after a while, so don't try for long.
 	brokerPath := s.url.ResolveReference(&url.URL{Path: "answer"})
-	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
+	var resp []byte
+	for attempt := 0; ; attempt++ {
+		resp, err = s.Post(brokerPath.String(), bytes.NewBuffer(body), sessionHeader(sid))
+		if err == nil || attempt == answerRetries || !isRetryable(err) {
+			break
+		}
+		delay := answerRetryDelay << attempt
+		s.logMsg(slog.LevelWarn, fmt.Sprintf("error sending answer to broker, retrying in %v: %v", delay, err),
+			slog.String("session_id", sid), slog.Duration("delay", delay))
+		select {
+		case <-s.clock.After(delay):
+		case <-s.shutdown:
+			return fmt.Errorf("error sending answer to broker: %s", err.Error())
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("error sending answer to broker: %s", err.Error())
 	}
@@ -296,7 +703,9 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 	return nil
 }
 
-func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct{}) {
+// copyLoop copies data between c1 and c2 until either side closes, shutdown
+// is closed, or maxDuration (if non-zero) elapses, logging with logMsg.
+func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct{}, maxDuration time.Duration, logMsg logFunc) {
 	var once sync.Once
 	defer c2.Close()
 	defer c1.Close()
@@ -308,9 +717,12 @@ func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct
 		size := 2 * 1024
 		buffer := make([]byte, size)
 		// Ignore io.ErrClosedPipe because it is likely caused by the
-		// termination of copyer in the other direction.
+		// termination of copyer in the other direction. Writes to a
+		// webRTCConn block while the client's data channel has too much
+		// data buffered, which also pauses reading from the relay, and
+		// fail with io.ErrClosedPipe once copyLoop closes it.
 		if _, err := io.CopyBuffer(dst, src, buffer); err != nil && err != io.ErrClosedPipe {
-			log.Printf("io.CopyBuffer inside CopyLoop generated an error: %v", err)
+			logMsg(slog.LevelError, fmt.Sprintf("io.CopyBuffer inside CopyLoop generated an error: %v", err))
 		}
 		once.Do(func() {
 			close(done)
@@ -320,11 +732,20 @@ func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct
 	go copyer(c1, c2)
 	go copyer(c2, c1)
 
+	var expired <-chan time.Time
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
 	select {
 	case <-done:
 	case <-shutdown:
+	case <-expired:
+		logMsg(slog.LevelInfo, fmt.Sprintf("closing connection after reaching the maximum duration of %v", maxDuration))
 	}
-	log.Println("copy loop ended")
+	logMsg(slog.LevelInfo, "copy loop ended")
 }
 
 // We pass conn.RemoteAddr() as an additional parameter, rather than calling
@@ -332,59 +753,211 @@ func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct
 // otherwise occurs inside conn.pc.RemoteDescription() (called by RemoteAddr).
 // https://bugs.torproject.org/18628#comment:8
 func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteAddr net.Addr, relayURL string) {
+	defer sf.activeConns.remove(conn.pc)
 	defer conn.Close()
-	defer tokens.ret()
-
-	if relayURL == "" {
+	if relayURL == "" || sf.ForceRelayURL {
 		relayURL = sf.RelayURL
 	}
+	defer sf.endRelaySession(relayURL)
 
-	wsConn, err := connectToRelay(relayURL, remoteAddr)
+	if sf.AcceptConnection != nil && !sf.AcceptConnection(remoteAddr) {
+		sf.logMsg(slog.LevelInfo, "connection rejected by AcceptConnection")
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionRejected{RemoteAddr: remoteAddr})
+		return
+	}
+
+	if ip := clientIP(remoteAddr); sf.MaxConnectionsPerIP > 0 && ip != "" {
+		if !sf.ipConnections.add(ip, sf.MaxConnectionsPerIP) {
+			sf.logMsg(slog.LevelInfo, "connection rejected: too many connections from the client's address")
+			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionRejected{RemoteAddr: remoteAddr})
+			return
+		}
+		defer sf.ipConnections.remove(ip)
+	}
+
+	if err := sf.checkRelayOverrides(relayURL); err != nil {
+		sf.logMsg(slog.LevelError, err.Error(), slog.String("relay_url", relayURL))
+		return
+	}
+	if remoteAddr == nil {
+		conn.logMsg(slog.LevelWarn, "no remote address given in websocket", slog.String("relay_url", relayURL))
+	}
+	wsConn, err := connectToRelay(sf.relayDialer(), relayURL, relayClientIP(remoteAddr, sf.ClientIPMode), sf.relayHeader())
 	if err != nil {
-		log.Print(err)
+		conn.logMsg(slog.LevelError, err.Error(), slog.String("relay_url", relayURL))
 		return
 	}
+	conn.logMsg(slog.LevelInfo, fmt.Sprintf("Connected to relay: %v", relayURL), slog.String("relay_url", relayURL))
 	defer wsConn.Close()
+	sf.activeConns.add(wsConn)
+	defer sf.activeConns.remove(wsConn)
+
+	var clientConn, relayConn io.ReadWriteCloser = conn, wsConn
+	if sf.RelayWriteTimeout > 0 {
+		relayConn = newWriteTimeoutConn(wsConn, sf.RelayWriteTimeout)
+	}
+	var clientLimiters, relayLimiters []*rateLimiter
+	if sf.PerConnectionRateLimit > 0 {
+		clientLimiters = append(clientLimiters, newRateLimiter(sf.PerConnectionRateLimit))
+		relayLimiters = append(relayLimiters, newRateLimiter(sf.PerConnectionRateLimit))
+	}
+	if sf.totalRateLimiter != nil {
+		clientLimiters = append(clientLimiters, sf.totalRateLimiter)
+		relayLimiters = append(relayLimiters, sf.totalRateLimiter)
+	}
+	if len(clientLimiters) > 0 {
+		clientConn = newRateLimitedConn(clientConn, clientLimiters...)
+		relayConn = newRateLimitedConn(relayConn, relayLimiters...)
+	}
+
+	copyLoop(clientConn, relayConn, sf.shutdown, sf.MaxConnectionDuration, conn.logMsg.with(slog.String("relay_url", relayURL)))
+	conn.logMsg(slog.LevelInfo, "datachannelHandler ends", slog.String("relay_url", relayURL))
+}
+
+// relayDialer returns the websocket dialer used to connect to the relay.
+func (sf *SnowflakeProxy) relayDialer() *websocket.Dialer {
+	if sf.outboundProxy == nil && sf.RelaySNIOverride == "" && !sf.EnableRelayCompression {
+		return websocket.DefaultDialer
+	}
+	dialer := *websocket.DefaultDialer
+	if sf.outboundProxy != nil {
+		// The websocket package handles both http and socks5 proxies.
+		dialer.Proxy = http.ProxyURL(sf.outboundProxy)
+	}
+	if sf.RelaySNIOverride != "" {
+		dialer.TLSClientConfig = &tls.Config{ServerName: sf.RelaySNIOverride}
+	}
+	dialer.EnableCompression = sf.EnableRelayCompression
+	return &dialer
+}
+
+// relayHeader returns the extra header fields of requests to the relay, which
+// may be nil.
+func (sf *SnowflakeProxy) relayHeader() http.Header {
+	if sf.RelayHostOverride == "" && len(sf.RelayHeaders) == 0 {
+		return nil
+	}
+	header := sf.RelayHeaders.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if sf.RelayHostOverride != "" {
+		// The websocket package uses this as the Host of the request.
+		header.Set("Host", sf.RelayHostOverride)
+	}
+	return header
+}
+
+// websocketHandshakeHeaders are the header fields that the websocket package
+// sets itself, and refuses to take from the caller.
+var websocketHandshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+}
+
+// checkRelayHeaders returns an error if RelayHeaders has a header field that
+// cannot be sent to the relay.
+func (sf *SnowflakeProxy) checkRelayHeaders() error {
+	for _, name := range websocketHandshakeHeaders {
+		if _, ok := sf.RelayHeaders[name]; ok {
+			return fmt.Errorf("invalid relay header %q: set by the WebSocket handshake", name)
+		}
+	}
+	return nil
+}
+
+// checkRelayOverrides returns an error if the Host or SNI overrides are set,
+// but cannot be used with relayURL.
+func (sf *SnowflakeProxy) checkRelayOverrides(relayURL string) error {
+	if sf.RelayHostOverride == "" && sf.RelaySNIOverride == "" {
+		return nil
+	}
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return fmt.Errorf("invalid relay url: %s", err)
+	}
+	if u.Scheme != "wss" {
+		return fmt.Errorf("relay Host and SNI overrides require a wss relay, not %q", u.Scheme)
+	}
+	return nil
+}
 
-	copyLoop(conn, wsConn, sf.shutdown)
-	log.Printf("datachannelHandler ends")
+// unixRelayDialer returns a copy of dialer that connects to the unix domain
+// socket at socketPath, whatever the address in the websocket URL.
+func unixRelayDialer(dialer *websocket.Dialer, socketPath string) *websocket.Dialer {
+	unixDialer := *dialer
+	unixDialer.Proxy = nil
+	unixDialer.NetDial = nil
+	unixDialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}
+	return &unixDialer
 }
 
-func connectToRelay(relayURL string, remoteAddr net.Addr) (*websocketconn.Conn, error) {
+// connectToRelay connects to the relay at relayURL. If clientIP is not
+// empty, it is passed to the relay in the client_ip query parameter.
+func connectToRelay(dialer *websocket.Dialer, relayURL string, clientIP string, header http.Header) (*websocketconn.Conn, error) {
 	u, err := url.Parse(relayURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid relay url: %s", err)
 	}
 
-	if remoteAddr != nil {
+	if clientIP != "" {
 		// Encode client IP address in relay URL
 		q := u.Query()
-		clientIP := remoteAddr.String()
 		q.Set("client_ip", clientIP)
 		u.RawQuery = q.Encode()
-	} else {
-		log.Printf("no remote address given in websocket")
 	}
 
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if u.Scheme == unixRelayScheme {
+		dialer = unixRelayDialer(dialer, u.Path)
+		u = &url.URL{Scheme: "ws", Host: "localhost", Path: "/", RawQuery: u.RawQuery}
+	}
+
+	ws, _, err := dialer.Dial(u.String(), header)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing relay: %s = %s", u.String(), err)
 	}
 
 	wsConn := websocketconn.New(ws)
-	log.Printf("Connected to relay: %v", relayURL)
 	return wsConn, nil
 }
 
+// clientConnection describes the client connection that a session may set
+// up, for the events about it.
+type clientConnection struct {
+	// ID identifies the connection in events. It is random, and is not
+	// the session ID sent to the broker.
+	ID      string
+	NATType string
+}
+
 type dataChannelHandlerWithRelayURL struct {
 	RelayURL string
 	sf       *SnowflakeProxy
+	// offerSDP is the client's offer, removed from the proxy's active
+	// offers once the connection is over.
+	offerSDP string
 }
 
 func (d dataChannelHandlerWithRelayURL) datachannelHandler(conn *webRTCConn, remoteAddr net.Addr) {
+	defer d.sf.activeOffers.remove(d.offerSDP)
 	d.sf.datachannelHandler(conn, remoteAddr, d.RelayURL)
 }
 
+// outboundAddresses returns all the configured outbound addresses.
+func (sf *SnowflakeProxy) outboundAddresses() []string {
+	var addresses []string
+	if sf.OutboundAddress != "" {
+		addresses = append(addresses, sf.OutboundAddress)
+	}
+	return append(addresses, sf.OutboundAddresses...)
+}
+
 func (sf *SnowflakeProxy) makeWebRTCAPI() *webrtc.API {
 	settingsEngine := webrtc.SettingEngine{}
 
@@ -409,14 +982,15 @@ func (sf *SnowflakeProxy) makeWebRTCAPI() *webrtc.API {
 	if sf.EphemeralMinPort != 0 && sf.EphemeralMaxPort != 0 {
 		err := settingsEngine.SetEphemeralUDPPortRange(sf.EphemeralMinPort, sf.EphemeralMaxPort)
 		if err != nil {
-			log.Fatal("Invalid port range: min > max")
+			// The port range is validated in Start, so this should not happen.
+			sf.logMsg(slog.LevelError, fmt.Sprintf("error setting ephemeral port range: %v", err))
 		}
 	}
 
-	if sf.OutboundAddress != "" {
-		// replace SDP host candidates with the given IP without validation
+	if outboundAddresses := sf.outboundAddresses(); len(outboundAddresses) > 0 {
+		// replace SDP host candidates with the given IPs
 		// still have server reflexive candidates to fall back on
-		settingsEngine.SetNAT1To1IPs([]string{sf.OutboundAddress}, webrtc.ICECandidateTypeHost)
+		settingsEngine.SetNAT1To1IPs(outboundAddresses, webrtc.ICECandidateTypeHost)
 	}
 
 	settingsEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
@@ -429,8 +1003,13 @@ func (sf *SnowflakeProxy) makeWebRTCAPI() *webrtc.API {
 // Create a PeerConnection from an SDP offer. Blocks until the gathering of ICE
 // candidates is complete and the answer is available in LocalDescription.
 // Installs an OnDataChannel callback that creates a webRTCConn and passes it to
-// datachannelHandler.
+// datachannelHandler. The events sent when the connection starts and ends
+// carry client's ID.
+//
+// If sf.TrickleICE is set, it only blocks until a host candidate has been
+// gathered.
 func (sf *SnowflakeProxy) makePeerConnectionFromOffer(
+	sid string, client clientConnection,
 	sdp *webrtc.SessionDescription,
 	config webrtc.Configuration, dataChan chan struct{},
 	handler func(conn *webRTCConn, remoteAddr net.Addr),
@@ -441,14 +1020,74 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(
 		return nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
 	}
 
+	var candidates chan *webrtc.ICECandidate
+	if sf.TrickleICE {
+		candidates = make(chan *webrtc.ICECandidate, trickleBufferSize)
+		pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+			if c == nil {
+				// Gathering is complete.
+				close(candidates)
+				return
+			}
+			select {
+			case candidates <- c:
+			default:
+				sf.logMsg(slog.LevelWarn, "dropping ICE candidate: too many pending candidates", slog.String("session_id", sid))
+			}
+		})
+	}
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyICEConnectionStateChange{
+			SessionID: sid,
+			State:     state,
+		})
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyPeerConnectionStateChange{
+			SessionID: sid,
+			State:     state,
+		})
+	})
+
+	// The first data channel carries the session. A client with
+	// WebRTCPeerOptions.DualDataChannels set then opens a bulk data channel,
+	// labeled with the first channel's label followed by "-bulk", whose
+	// messages are read into the same connection. Any other data channel is
+	// closed once open: before that, Close does not reach the client.
+	var channelsLock sync.Mutex
+	var controlLabel string
+	var bulkAccepted bool
+	var receive func(msg webrtc.DataChannelMessage)
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-		log.Printf("New Data Channel %s-%d\n", dc.Label(), dc.ID())
+		channelsLock.Lock()
+		defer channelsLock.Unlock()
+		if receive != nil {
+			if bulkAccepted || dc.Label() != controlLabel+"-bulk" {
+				sf.logMsg(slog.LevelWarn, fmt.Sprintf("Ignoring extra Data Channel %s-%d", dc.Label(), dc.ID()), slog.String("session_id", sid))
+				dc.OnOpen(func() { dc.Close() })
+				return
+			}
+			bulkAccepted = true
+			sf.logMsg(slog.LevelInfo, fmt.Sprintf("New bulk Data Channel %s-%d", dc.Label(), dc.ID()), slog.String("session_id", sid))
+			dc.OnMessage(receive)
+			dc.OnClose(func() {
+				sf.logMsg(slog.LevelInfo, fmt.Sprintf("Data Channel %s-%d close", dc.Label(), dc.ID()), slog.String("session_id", sid))
+			})
+			return
+		}
+		controlLabel = dc.Label()
+		sf.logMsg(slog.LevelInfo, fmt.Sprintf("New Data Channel %s-%d", dc.Label(), dc.ID()), slog.String("session_id", sid))
 		close(dataChan)
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionStarted{
+			ConnectionID:  client.ID,
+			ClientNATType: client.NATType,
+		})
 
 		pr, pw := io.Pipe()
-		conn := newWebRTCConn(pc, dc, pr, sf.bytesLogger)
+		conn := newWebRTCConn(pc, dc, pr, sf.bytesLogger, logFunc(sf.logMsg).with(slog.String("session_id", sid)))
 
-		dc.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+		dc.SetBufferedAmountLowThreshold(sf.BufferedAmountLowThreshold)
 
 		dc.OnBufferedAmountLow(func() {
 			select {
@@ -458,48 +1097,80 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(
 		})
 
 		dc.OnOpen(func() {
-			log.Printf("Data Channel %s-%d open\n", dc.Label(), dc.ID())
+			sf.logMsg(slog.LevelInfo, fmt.Sprintf("Data Channel %s-%d open", dc.Label(), dc.ID()), slog.String("session_id", sid))
 			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyClientConnected{})
 
-			if sf.OutboundAddress != "" {
-				selectedCandidatePair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
-				if err != nil {
-					log.Printf("Warning: couldn't get the selected candidate pair")
+			selectedCandidatePair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+			if err != nil || selectedCandidatePair == nil {
+				sf.logMsg(slog.LevelWarn, "Warning: couldn't get the selected candidate pair", slog.String("session_id", sid))
+				return
+			}
+			sf.logMsg(slog.LevelInfo,
+				fmt.Sprintf("Selected Local Candidate: %s:%d", selectedCandidatePair.Local.Address, selectedCandidatePair.Local.Port),
+				slog.String("session_id", sid))
+			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyCandidatePairSelected{
+				LocalCandidateType:  selectedCandidatePair.Local.Typ,
+				LocalAddress:        selectedCandidatePair.Local.Address,
+				RemoteCandidateType: selectedCandidatePair.Remote.Typ,
+				RemoteAddress:       selectedCandidatePair.Remote.Address,
+			})
+
+			if outboundAddresses := sf.outboundAddresses(); len(outboundAddresses) > 0 {
+				used := false
+				for _, address := range outboundAddresses {
+					if address == selectedCandidatePair.Local.Address {
+						used = true
+						break
+					}
 				}
-
-				log.Printf("Selected Local Candidate: %s:%d", selectedCandidatePair.Local.Address, selectedCandidatePair.Local.Port)
-				if sf.OutboundAddress != selectedCandidatePair.Local.Address {
-					log.Printf("Warning: the IP address provided by --outbound-address is not used for establishing peerconnection")
+				if !used {
+					sf.logMsg(slog.LevelWarn, "Warning: the IP address provided by --outbound-address is not used for establishing peerconnection",
+						slog.String("session_id", sid))
 				}
 			}
 		})
 		dc.OnClose(func() {
 			conn.lock.Lock()
 			defer conn.lock.Unlock()
-			log.Printf("Data Channel %s-%d close\n", dc.Label(), dc.ID())
-			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionOver{})
+			inbound, outbound := conn.GetStat()
+			ratio := trafficRatio(inbound, outbound)
+			sf.logMsg(slog.LevelInfo, fmt.Sprintf("Data Channel %s-%d close", dc.Label(), dc.ID()),
+				slog.String("session_id", sid), slog.Int64("inbound_bytes", inbound), slog.Int64("outbound_bytes", outbound))
+			if sf.AsymmetricTrafficRatio > 0 && max(inbound, outbound) >= asymmetricTrafficMinBytes && ratio > sf.AsymmetricTrafficRatio {
+				sf.logMsg(slog.LevelWarn, fmt.Sprintf("asymmetric traffic on closed connection: ratio %.1f exceeds %.1f", ratio, sf.AsymmetricTrafficRatio),
+					slog.String("session_id", sid), slog.Int64("inbound_bytes", inbound), slog.Int64("outbound_bytes", outbound))
+			}
+			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyConnectionOver{
+				ConnectionID:    client.ID,
+				InboundTraffic:  inbound,
+				OutboundTraffic: outbound,
+				InboundBytes:    inbound,
+				OutboundBytes:   outbound,
+				TrafficRatio:    ratio,
+			})
 			conn.dc = nil
 			dc.Close()
 			pw.Close()
 		})
-		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-			var n int
-			n, err = pw.Write(msg.Data)
+		receive = func(msg webrtc.DataChannelMessage) {
+			n, err := pw.Write(msg.Data)
 			if err != nil {
 				if inErr := pw.CloseWithError(err); inErr != nil {
-					log.Printf("close with error generated an error: %v", inErr)
+					sf.logMsg(slog.LevelError, fmt.Sprintf("close with error generated an error: %v", inErr), slog.String("session_id", sid))
 				}
 
 				return
 			}
 
 			conn.bytesLogger.AddOutbound(int64(n))
+			conn.outboundBytes.Add(int64(n))
 
 			if n != len(msg.Data) {
 				// XXX: Maybe don't panic here and log an error instead?
 				panic("short write")
 			}
-		})
+		}
+		dc.OnMessage(receive)
 
 		go handler(conn, conn.RemoteAddr())
 	})
@@ -510,46 +1181,95 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(
 	err = pc.SetRemoteDescription(*sdp)
 	if err != nil {
 		if inerr := pc.Close(); inerr != nil {
-			log.Printf("unable to call pc.Close after pc.SetRemoteDescription with error: %v", inerr)
+			sf.logMsg(slog.LevelError, fmt.Sprintf("unable to call pc.Close after pc.SetRemoteDescription with error: %v", inerr), slog.String("session_id", sid))
 		}
 		return nil, fmt.Errorf("accept: SetRemoteDescription: %s", err)
 	}
 
-	log.Println("Generating answer...")
+	sf.logMsg(slog.LevelInfo, "Generating answer...", slog.String("session_id", sid))
 	answer, err := pc.CreateAnswer(nil)
 	// blocks on ICE gathering. we need to add a timeout if needed
 	// not putting this in a separate go routine, because we need
 	// SetLocalDescription(answer) to be called before sendAnswer
 	if err != nil {
 		if inerr := pc.Close(); inerr != nil {
-			log.Printf("ICE gathering has generated an error when calling pc.Close: %v", inerr)
+			sf.logMsg(slog.LevelError, fmt.Sprintf("ICE gathering has generated an error when calling pc.Close: %v", inerr), slog.String("session_id", sid))
 		}
 		return nil, err
 	}
 
+	gatheringStart := time.Now()
 	err = pc.SetLocalDescription(answer)
 	if err != nil {
 		if err = pc.Close(); err != nil {
-			log.Printf("pc.Close after setting local description returned : %v", err)
+			sf.logMsg(slog.LevelError, fmt.Sprintf("pc.Close after setting local description returned : %v", err), slog.String("session_id", sid))
 		}
 		return nil, err
 	}
 
+	if sf.TrickleICE {
+		// Candidates received here are already in the local description.
+		if !waitForHostCandidate(candidates, snowflakeClient.DataChannelTimeout/2) {
+			sf.logMsg(slog.LevelWarn, "no host candidate gathered yet, but let's send the answer"+
+				" before the client times out", slog.String("session_id", sid))
+		}
+		sf.logMsg(slog.LevelDebug, fmt.Sprintf("Answer: \n\t%s", strings.ReplaceAll(pc.LocalDescription().SDP, "\n", "\n\t")), slog.String("session_id", sid))
+		// The broker cannot pass the candidates gathered from now on to
+		// the client, so they are not sent. Gathering is reported once
+		// it is complete.
+		go func() {
+			for range candidates {
+			}
+			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnICEGatheringComplete{
+				SessionID:       sid,
+				Duration:        time.Since(gatheringStart),
+				ServerReflexive: hasServerReflexiveCandidate(pc.LocalDescription().SDP),
+			})
+		}()
+		return pc, nil
+	}
+
 	// Wait for ICE candidate gathering to complete,
 	// or for whatever we managed to gather before the client times out.
 	// See https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40230
+	timedOut := false
 	select {
 	case <-done:
 	case <-time.After(snowflakeClient.DataChannelTimeout / 2):
-		log.Print("ICE gathering is not yet complete, but let's send the answer" +
-			" before the client times out")
-	}
+		sf.logMsg(slog.LevelWarn, "ICE gathering is not yet complete, but let's send the answer"+
+			" before the client times out", slog.String("session_id", sid))
+		timedOut = true
+	}
+	sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnICEGatheringComplete{
+		SessionID:       sid,
+		Duration:        time.Since(gatheringStart),
+		TimedOut:        timedOut,
+		ServerReflexive: hasServerReflexiveCandidate(pc.LocalDescription().SDP),
+	})
 
-	log.Printf("Answer: \n\t%s", strings.ReplaceAll(pc.LocalDescription().SDP, "\n", "\n\t"))
+	sf.logMsg(slog.LevelDebug, fmt.Sprintf("Answer: \n\t%s", strings.ReplaceAll(pc.LocalDescription().SDP, "\n", "\n\t")), slog.String("session_id", sid))
 
 	return pc, nil
 }
 
+// waitForHostCandidate reads from candidates until it receives a host
+// candidate or the channel is closed, in which case it returns true, or until
+// timeout elapses, in which case it returns false.
+func waitForHostCandidate(candidates <-chan *webrtc.ICECandidate, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case c, ok := <-candidates:
+			if !ok || c.Typ == webrtc.ICECandidateTypeHost {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
 // Create a new PeerConnection. Blocks until the gathering of ICE
 // candidates is complete and the answer is available in LocalDescription.
 func (sf *SnowflakeProxy) makeNewPeerConnection(
@@ -561,33 +1281,33 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(
 		return nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
 	}
 	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
-		log.Printf("NAT check: WebRTC: OnConnectionStateChange: %v", pcs)
+		sf.logMsg(slog.LevelInfo, fmt.Sprintf("NAT check: WebRTC: OnConnectionStateChange: %v", pcs))
 	})
 
 	// Must create a data channel before creating an offer
 	// https://github.com/pion/webrtc/wiki/Release-WebRTC@v3.0.0#a-data-channel-is-no-longer-implicitly-created-with-a-peerconnection
-	dc, err := pc.CreateDataChannel("test", &webrtc.DataChannelInit{})
+	dc, err := pc.CreateDataChannel(sf.ProbeDataChannelLabel, &webrtc.DataChannelInit{})
 	if err != nil {
-		log.Printf("CreateDataChannel ERROR: %s", err)
+		sf.logMsg(slog.LevelError, fmt.Sprintf("CreateDataChannel ERROR: %s", err))
 		return nil, err
 	}
 	dc.OnOpen(func() {
-		log.Println("WebRTC: DataChannel.OnOpen")
+		sf.logMsg(slog.LevelInfo, "WebRTC: DataChannel.OnOpen")
 		close(dataChan)
 	})
 	dc.OnClose(func() {
-		log.Println("WebRTC: DataChannel.OnClose")
+		sf.logMsg(slog.LevelInfo, "WebRTC: DataChannel.OnClose")
 		dc.Close()
 	})
 
 	offer, err := pc.CreateOffer(nil)
 	// TODO: Potentially timeout and retry if ICE isn't working.
 	if err != nil {
-		log.Println("Failed to prepare offer", err)
+		sf.logMsg(slog.LevelError, fmt.Sprintf("Failed to prepare offer %v", err))
 		pc.Close()
 		return nil, err
 	}
-	log.Println("Probetest: Created Offer")
+	sf.logMsg(slog.LevelInfo, "Probetest: Created Offer")
 
 	// As of v3.0.0, pion-webrtc uses trickle ICE by default.
 	// We have to wait for candidate gathering to complete
@@ -596,11 +1316,11 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(
 	// start the gathering of ICE candidates
 	err = pc.SetLocalDescription(offer)
 	if err != nil {
-		log.Println("Failed to apply offer", err)
+		sf.logMsg(slog.LevelError, fmt.Sprintf("Failed to apply offer %v", err))
 		pc.Close()
 		return nil, err
 	}
-	log.Println("Probetest: Set local description")
+	sf.logMsg(slog.LevelInfo, "Probetest: Set local description")
 
 	// Wait for ICE candidate gathering to complete
 	<-done
@@ -609,65 +1329,223 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(
 }
 
 func (sf *SnowflakeProxy) runSession(sid string) {
-	offer, relayURL := broker.pollOffer(sid, sf.ProxyType, sf.RelayDomainNamePattern)
+	clock := sf.getClock()
+	pollStart := clock.Now()
+	offer, clientNATType, relayURL, err := sf.broker.pollOffer(sid, sf.ProxyType, sf.getCurrentNATType(), sf.brokerRelayPattern(), sf.tokens.Count())
+	pollResponse := event.EventOnProxyPollResponse{
+		MatchedOffer: offer != nil,
+		PollDuration: clock.Now().Sub(pollStart),
+	}
+	if err != nil {
+		pollResponse.Error = err.Error()
+	}
+	sf.EventDispatcher.OnNewSnowflakeEvent(pollResponse)
+	if err != nil {
+		sf.logMsg(slog.LevelError, err.Error(), slog.String("session_id", sid))
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyPollFailed{Error: err})
+		sf.pollFailures++
+		sf.pollRetryAfter = 0
+		var rateLimitErr rateLimitError
+		if errors.As(err, &rateLimitErr) {
+			sf.pollRetryAfter = rateLimitErr.retryAfter
+		}
+		sf.endSession()
+		return
+	}
+	sf.pollFailures = 0
+	sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyPollSucceeded{})
 	if offer == nil {
-		log.Printf("bad offer from broker")
-		tokens.ret()
+		sf.logMsg(slog.LevelInfo, "bad offer from broker", slog.String("session_id", sid))
+		sf.endSession()
+		return
+	}
+	if err := checkOffer(offer, sf.MaxOfferSize); err != nil {
+		sf.logMsg(slog.LevelWarn, fmt.Sprintf("rejected offer from broker: %v", err), slog.String("session_id", sid))
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyOfferRejected{SessionID: sid, Reason: err.Error()})
+		sf.endSession()
+		return
+	}
+	if !sf.activeOffers.add(offer.SDP) {
+		sf.logMsg(slog.LevelInfo, "dropping duplicate offer from broker", slog.String("session_id", sid))
+		sf.endSession()
+		return
+	}
+	// The offer stays in activeOffers for as long as the session lasts, so
+	// that the broker cannot match us with it again in the meantime. Once the
+	// client connects, the data channel handler removes it.
+	offerHandedOff := false
+	defer func() {
+		if !offerHandedOff {
+			sf.activeOffers.remove(offer.SDP)
+		}
+	}()
+	sf.logMsg(slog.LevelInfo, fmt.Sprintf("Received Offer From Broker: \n\t%s", strings.ReplaceAll(offer.SDP, "\n", "\n\t")),
+		slog.String("session_id", sid), slog.String("client_nat_type", clientNATType), slog.String("relay_url", relayURL))
+
+	if !sf.servesClientNATType(clientNATType) {
+		// The broker may not know about ServeClientNATTypes.
+		reason := fmt.Sprintf("not serving clients with NAT type %v", clientNATType)
+		sf.logMsg(slog.LevelInfo, "rejected offer from broker: "+reason,
+			slog.String("session_id", sid), slog.String("client_nat_type", clientNATType))
+		sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyOfferRejected{SessionID: sid, Reason: reason})
+		sf.endSession()
 		return
 	}
-	log.Printf("Received Offer From Broker: \n\t%s", strings.ReplaceAll(offer.SDP, "\n", "\n\t"))
 
+	if sf.ForceRelayURL && relayURL != "" && relayURL != sf.RelayURL {
+		sf.logMsg(slog.LevelInfo, "ignoring relay URL from broker, using the configured relay URL",
+			slog.String("session_id", sid), slog.String("relay_url", relayURL))
+		relayURL = ""
+	}
 	if relayURL != "" {
-		if err := checkIsRelayURLAcceptable(sf.RelayDomainNamePattern, sf.AllowProxyingToPrivateAddresses, sf.AllowNonTLSRelay, relayURL); err != nil {
-			log.Printf("bad offer from broker: %v", err)
-			tokens.ret()
+		if err := checkIsRelayURLAcceptable(sf.relayDomainNamePatterns(), sf.AllowProxyingToPrivateAddresses, sf.AllowNonTLSRelay, sf.AllowUnixRelay, relayURL); err != nil {
+			sf.logMsg(slog.LevelWarn, fmt.Sprintf("bad offer from broker: %v", err),
+				slog.String("session_id", sid), slog.String("relay_url", relayURL))
+			rejected := event.EventOnProxyRelayRejected{SessionID: sid, RelayURL: relayURL}
+			var rejectedErr *relayRejectedError
+			if errors.As(err, &rejectedErr) {
+				rejected.Reason = rejectedErr.reason
+			}
+			sf.EventDispatcher.OnNewSnowflakeEvent(rejected)
+			sf.endSession()
 			return
 		}
 	}
 
+	relayKey := relayURL
+	if relayKey == "" {
+		relayKey = sf.RelayURL
+	}
+	if !sf.relayTokens.tryGet(relayKey) {
+		sf.logMsg(slog.LevelInfo, "rejected offer from broker: at capacity for relay",
+			slog.String("session_id", sid), slog.String("relay_url", relayKey))
+		sf.endSession()
+		return
+	}
+
 	dataChan := make(chan struct{})
-	dataChannelAdaptor := dataChannelHandlerWithRelayURL{RelayURL: relayURL, sf: sf}
-	pc, err := sf.makePeerConnectionFromOffer(offer, config, dataChan, dataChannelAdaptor.datachannelHandler)
+	dataChannelAdaptor := dataChannelHandlerWithRelayURL{RelayURL: relayURL, sf: sf, offerSDP: offer.SDP}
+	clientID, err := sf.newSessionID()
+	if err != nil {
+		sf.logMsg(slog.LevelError, fmt.Sprintf("error generating client ID: %s", err), slog.String("session_id", sid))
+		sf.endRelaySession(relayKey)
+		return
+	}
+	client := clientConnection{ID: clientID, NATType: clientNATType}
+	pc, err := sf.makePeerConnectionFromOffer(sid, client, offer, sf.config, dataChan, dataChannelAdaptor.datachannelHandler)
 	if err != nil {
-		log.Printf("error making WebRTC connection: %s", err)
-		tokens.ret()
+		sf.logMsg(slog.LevelError, fmt.Sprintf("error making WebRTC connection: %s", err), slog.String("session_id", sid))
+		sf.endRelaySession(relayKey)
 		return
 	}
+	// If the client connects, datachannelHandler removes pc once the
+	// connection is over.
+	sf.activeConns.add(pc)
 
-	err = broker.sendAnswer(sid, pc)
+	err = sf.broker.sendAnswer(sid, pc)
 	if err != nil {
-		log.Printf("error sending answer to client through broker: %s", err)
+		sf.logMsg(slog.LevelError, fmt.Sprintf("error sending answer to client through broker: %s", err), slog.String("session_id", sid))
 		if inerr := pc.Close(); inerr != nil {
-			log.Printf("error calling pc.Close: %v", inerr)
+			sf.logMsg(slog.LevelError, fmt.Sprintf("error calling pc.Close: %v", inerr), slog.String("session_id", sid))
 		}
-		tokens.ret()
+		sf.activeConns.remove(pc)
+		sf.endRelaySession(relayKey)
 		return
 	}
 	// Set a timeout on peerconnection. If the connection state has not
 	// advanced to PeerConnectionStateConnected in this time,
 	// destroy the peer connection and return the token.
+	timeout := dataChannelTimeout
+	if sf.ClientConnectionTimeout != 0 {
+		timeout = sf.ClientConnectionTimeout
+	}
 	select {
 	case <-dataChan:
-		log.Println("Connection successful")
-	case <-time.After(dataChannelTimeout):
-		log.Println("Timed out waiting for client to open data channel.")
+		sf.logMsg(slog.LevelInfo, "Connection successful", slog.String("session_id", sid))
+		offerHandedOff = true
+	case <-clock.After(timeout):
+		sf.logMsg(slog.LevelInfo, "Timed out waiting for client to open data channel.", slog.String("session_id", sid))
 		if err := pc.Close(); err != nil {
-			log.Printf("error calling pc.Close: %v", err)
+			sf.logMsg(slog.LevelError, fmt.Sprintf("error calling pc.Close: %v", err), slog.String("session_id", sid))
 		}
-		tokens.ret()
+		sf.activeConns.remove(pc)
+		sf.endRelaySession(relayKey)
 	}
 }
 
+// checkServeClientNATTypes returns an error if ServeClientNATTypes has an
+// unknown NAT type.
+func (sf *SnowflakeProxy) checkServeClientNATTypes() error {
+	for _, natType := range sf.ServeClientNATTypes {
+		switch natType {
+		case NATUnknown, NATRestricted, NATUnrestricted:
+		default:
+			return fmt.Errorf("invalid client NAT type %q", natType)
+		}
+	}
+	return nil
+}
+
+// servesClientNATType reports whether the proxy accepts offers from clients
+// with the given NAT type.
+func (sf *SnowflakeProxy) servesClientNATType(natType string) bool {
+	if len(sf.ServeClientNATTypes) == 0 {
+		return true
+	}
+	for _, t := range sf.ServeClientNATTypes {
+		if t == natType {
+			return true
+		}
+	}
+	return false
+}
+
+// Reasons for which a relay URL is rejected, as reported in
+// EventOnProxyRelayRejected.
+const (
+	RelayRejectedInvalidURL     = "invalid URL"
+	RelayRejectedProtocol       = "protocol not allowed"
+	RelayRejectedPrivateAddress = "private address"
+	RelayRejectedNonTLS         = "non-TLS relay"
+	RelayRejectedPattern        = "hostname pattern mismatch"
+)
+
+// relayRejectedError is the error of checkIsRelayURLAcceptable. reason is one
+// of the RelayRejected constants.
+type relayRejectedError struct {
+	reason string
+	err    error
+}
+
+func (e *relayRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *relayRejectedError) Unwrap() error {
+	return e.err
+}
+
 // Returns nil if the relayURL is acceptable
 func checkIsRelayURLAcceptable(
-	allowedHostNamePattern string,
+	allowedHostNamePatterns []string,
 	allowPrivateIPs bool,
 	allowNonTLSRelay bool,
+	allowUnixRelay bool,
 	relayURL string,
 ) error {
 	parsedRelayURL, err := url.Parse(relayURL)
 	if err != nil {
-		return fmt.Errorf("bad Relay URL %w", err)
+		return &relayRejectedError{RelayRejectedInvalidURL, fmt.Errorf("bad Relay URL %w", err)}
+	}
+	if parsedRelayURL.Scheme == unixRelayScheme {
+		// The socket is local, so hostname and TLS checks don't apply.
+		if !allowUnixRelay {
+			return &relayRejectedError{RelayRejectedProtocol, fmt.Errorf("rejected Relay URL protocol: unix sockets not allowed")}
+		}
+		if parsedRelayURL.Path == "" {
+			return &relayRejectedError{RelayRejectedInvalidURL, fmt.Errorf("rejected Relay URL: missing unix socket path")}
+		}
+		return nil
 	}
 	if !allowPrivateIPs {
 		ip := net.ParseIP(parsedRelayURL.Hostname())
@@ -675,37 +1553,138 @@ func checkIsRelayURLAcceptable(
 		if ip != nil {
 			// We should probably use a ready library for this.
 			if !isRemoteAddress(ip) {
-				return fmt.Errorf("rejected Relay URL: private IPs are not allowed")
+				return &relayRejectedError{RelayRejectedPrivateAddress, fmt.Errorf("rejected Relay URL: private IPs are not allowed")}
 			}
 		}
 	}
 	if !allowNonTLSRelay && parsedRelayURL.Scheme != "wss" {
-		return fmt.Errorf("rejected Relay URL protocol: non-TLS not allowed")
+		return &relayRejectedError{RelayRejectedNonTLS, fmt.Errorf("rejected Relay URL protocol: non-TLS not allowed")}
 	}
 	// FYI our websocket library also rejects other protocols
 	// https://github.com/gorilla/websocket/blob/5e002381133d322c5f1305d171f3bdd07decf229/client.go#L174-L181
 	if parsedRelayURL.Scheme != "wss" && parsedRelayURL.Scheme != "ws" {
-		return fmt.Errorf("rejected Relay URL protocol: only WebSocket is allowed")
+		return &relayRejectedError{RelayRejectedProtocol, fmt.Errorf("rejected Relay URL protocol: only WebSocket is allowed")}
+	}
+	for _, pattern := range allowedHostNamePatterns {
+		matcher := namematcher.NewNameMatcher(pattern)
+		if matcher.IsMember(parsedRelayURL.Hostname()) {
+			return nil
+		}
+	}
+	return &relayRejectedError{RelayRejectedPattern, fmt.Errorf("rejected Relay URL: hostname does not match allowed pattern \"%v\"", strings.Join(allowedHostNamePatterns, "\", \""))}
+}
+
+// relayDomainNamePatterns returns RelayDomainNamePattern, if set, followed by
+// RelayDomainNamePatterns.
+func (sf *SnowflakeProxy) relayDomainNamePatterns() []string {
+	var patterns []string
+	if sf.RelayDomainNamePattern != "" {
+		patterns = append(patterns, sf.RelayDomainNamePattern)
+	}
+	return append(patterns, sf.RelayDomainNamePatterns...)
+}
+
+// brokerRelayPattern returns the relay domain name pattern to send to the
+// broker, which only supports one.
+func (sf *SnowflakeProxy) brokerRelayPattern() string {
+	if patterns := sf.relayDomainNamePatterns(); len(patterns) > 0 {
+		return patterns[0]
+	}
+	return ""
+}
+
+// makeICEServers validates the configured STUN URLs and returns the
+// corresponding ICE servers.
+func (sf *SnowflakeProxy) makeICEServers() ([]webrtc.ICEServer, error) {
+	if len(sf.STUNURLs) == 0 {
+		_, err := url.Parse(sf.STUNURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stun url: %s", err)
+		}
+		return []webrtc.ICEServer{
+			{
+				URLs: strings.Split(sf.STUNURL, ","),
+			},
+		}, nil
+	}
+
+	var iceServers []webrtc.ICEServer
+	var errs []error
+	for _, stunURL := range sf.STUNURLs {
+		_, err := url.Parse(stunURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid stun url %q: %s", stunURL, err))
+			continue
+		}
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs: []string{stunURL},
+		})
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return iceServers, nil
+}
+
+// makeTURNServers validates the configured TURN URLs and returns the
+// corresponding ICE servers, carrying the TURN credentials.
+func (sf *SnowflakeProxy) makeTURNServers() ([]webrtc.ICEServer, error) {
+	var iceServers []webrtc.ICEServer
+	var errs []error
+	for _, turnURL := range sf.TURNURLs {
+		_, err := url.Parse(turnURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid turn url %q: %s", turnURL, err))
+			continue
+		}
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:           []string{turnURL},
+			Username:       sf.TURNUsername,
+			Credential:     sf.TURNCredential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return iceServers, nil
+}
+
+// checkCertificate returns an error if cert cannot be used for DTLS.
+func checkCertificate(cert *webrtc.Certificate) error {
+	if expires := cert.Expires(); !expires.IsZero() && time.Now().After(expires) {
+		return fmt.Errorf("invalid certificate: expired at %v", expires)
 	}
-	matcher := namematcher.NewNameMatcher(allowedHostNamePattern)
-	if !matcher.IsMember(parsedRelayURL.Hostname()) {
-		return fmt.Errorf("rejected Relay URL: hostname does not match allowed pattern \"%v\"", allowedHostNamePattern)
+	if _, err := cert.GetFingerprints(); err != nil {
+		return fmt.Errorf("invalid certificate: %s", err)
 	}
 	return nil
 }
 
 // Start configures and starts a Snowflake, fully formed and special. Configuration
 // values that are unset will default to their corresponding default values.
+// Once Start has returned after Stop or Drain, it may be called again to
+// restart the proxy.
 func (sf *SnowflakeProxy) Start() error {
 	var err error
 
+	// The sessions of a previous run return their tokens to that run's
+	// token pool, so wait for them before setting up a new one.
+	sf.sessions.Wait()
+
+	sf.state.Store(int32(StateStarting))
 	sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyStarting{})
-	sf.shutdown = make(chan struct{})
+	pollDone := sf.initChannels(true)
+	defer close(pollDone)
+	defer sf.state.Store(int32(StateStopped))
 
 	// blank configurations revert to default
 	if sf.PollInterval == 0 {
 		sf.PollInterval = DefaultPollInterval
 	}
+	if sf.MaxPollBackoff == 0 {
+		sf.MaxPollBackoff = DefaultMaxPollBackoff
+	}
 	if sf.BrokerURL == "" {
 		sf.BrokerURL = DefaultBrokerURL
 	}
@@ -721,96 +1700,518 @@ func (sf *SnowflakeProxy) Start() error {
 	if sf.ProxyType == "" {
 		sf.ProxyType = DefaultProxyType
 	}
+	if sf.ProbeDataChannelLabel == "" {
+		sf.ProbeDataChannelLabel = DefaultProbeDataChannelLabel
+	}
 	if sf.EventDispatcher == nil {
 		sf.EventDispatcher = event.NewSnowflakeEventDispatcher()
 	}
+	if sf.BufferedAmountLowThreshold == 0 {
+		sf.BufferedAmountLowThreshold = DefaultBufferedAmountLowThreshold
+	}
+	if sf.MaxOfferSize == 0 {
+		sf.MaxOfferSize = DefaultMaxOfferSize
+	}
 
-	sf.bytesLogger = newBytesSyncLogger()
-	sf.periodicProxyStats = newPeriodicProxyStats(sf.SummaryInterval, sf.EventDispatcher, sf.bytesLogger)
+	if sf.PollInterval < 0 {
+		return fmt.Errorf("invalid poll interval %v: must be positive", sf.PollInterval)
+	}
+
+	if sf.PerConnectionRateLimit < 0 {
+		return fmt.Errorf("invalid per-connection rate limit %d: must be positive", sf.PerConnectionRateLimit)
+	}
+	if sf.TotalRateLimit < 0 {
+		return fmt.Errorf("invalid total rate limit %d: must be positive", sf.TotalRateLimit)
+	}
+	sf.totalRateLimiter = nil
+	if sf.TotalRateLimit > 0 {
+		sf.totalRateLimiter = newRateLimiter(sf.TotalRateLimit)
+	}
+
+	if sf.BufferedAmountLowThreshold >= maxBufferedAmount {
+		return fmt.Errorf("invalid buffered amount low threshold %d: must be less than %d",
+			sf.BufferedAmountLowThreshold, maxBufferedAmount)
+	}
+
+	if sf.EphemeralMinPort != 0 && sf.EphemeralMaxPort != 0 && sf.EphemeralMinPort > sf.EphemeralMaxPort {
+		return fmt.Errorf("invalid ephemeral port range %d-%d: min > max", sf.EphemeralMinPort, sf.EphemeralMaxPort)
+	}
+
+	if sf.BytesLogger == nil {
+		sf.BytesLogger = newBytesSyncLogger()
+	}
+	sf.bytesLogger = sf.BytesLogger
+	sf.periodicProxyStats = newPeriodicProxyStats(sf.SummaryInterval, sf.EventDispatcher, sf.BytesLogger, sf.getCurrentNATType)
 	sf.EventDispatcher.AddSnowflakeEventListener(sf.periodicProxyStats)
+	defer sf.periodicProxyStats.Close()
+	defer sf.EventDispatcher.RemoveSnowflakeEventListener(sf.periodicProxyStats)
+
+	if sf.MetricsListenAddr != "" {
+		metrics := NewMetrics()
+		err = metrics.Start(sf.MetricsListenAddr)
+		if err != nil {
+			return fmt.Errorf("could not enable metrics: %s", err)
+		}
+		defer metrics.Close()
+		eventMetrics := NewEventMetrics(metrics)
+		sf.EventDispatcher.AddSnowflakeEventListener(eventMetrics)
+		defer sf.EventDispatcher.RemoveSnowflakeEventListener(eventMetrics)
+	}
+
+	if sf.HealthListenAddr != "" {
+		health := newHealthCheck()
+		sf.EventDispatcher.AddSnowflakeEventListener(health)
+		defer sf.EventDispatcher.RemoveSnowflakeEventListener(health)
+		err = health.Start(sf.HealthListenAddr)
+		if err != nil {
+			return fmt.Errorf("could not enable health check: %s", err)
+		}
+		defer health.Close()
+	}
+
+	if sf.StatusListenAddr != "" {
+		status := newStatusServer(sf.BytesLogger, sf.activeSessions)
+		sf.bytesLogger = status
+		sf.EventDispatcher.AddSnowflakeEventListener(status)
+		defer sf.EventDispatcher.RemoveSnowflakeEventListener(status)
+		err = status.Start(sf.StatusListenAddr)
+		if err != nil {
+			return fmt.Errorf("could not enable status: %s", err)
+		}
+		defer status.Close()
+	}
 
-	broker, err = newSignalingServer(sf.BrokerURL)
+	sf.outboundProxy = nil
+	if sf.OutboundProxyURL != "" {
+		sf.outboundProxy, err = url.Parse(sf.OutboundProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid outbound proxy url: %s", err)
+		}
+		if sf.outboundProxy.Scheme != "socks5" && sf.outboundProxy.Scheme != "http" {
+			return fmt.Errorf("invalid outbound proxy url %q: scheme must be socks5 or http", sf.OutboundProxyURL)
+		}
+	}
+
+	sf.broker, err = newSignalingServer(sf.BrokerURL, sf.brokerTransport())
 	if err != nil {
 		return fmt.Errorf("error configuring broker: %s", err)
 	}
+	if sf.BrokerResponseLimit < 0 {
+		return fmt.Errorf("invalid broker response limit %d: must be positive", sf.BrokerResponseLimit)
+	}
+	if sf.BrokerResponseLimit > 0 {
+		sf.broker.readLimit = sf.BrokerResponseLimit
+	}
+	sf.broker.filterCandidate = sf.FilterCandidate
+	sf.broker.logMsg = sf.logMsg
+	sf.broker.clock = sf.getClock()
+	sf.broker.shutdown = sf.shutdown
+	sf.broker.bandwidthClass = sf.BandwidthClass
+	sf.broker.clientNATTypes = sf.ServeClientNATTypes
 
-	_, err = url.Parse(sf.STUNURL)
+	iceServers, err := sf.makeICEServers()
 	if err != nil {
-		return fmt.Errorf("invalid stun url: %s", err)
+		return err
+	}
+	// Relayed candidates gathered from TURN servers end up in the SDP
+	// answer alongside the host and server reflexive ones.
+	turnServers, err := sf.makeTURNServers()
+	if err != nil {
+		return err
 	}
+	iceServers = append(iceServers, turnServers...)
 	_, err = url.Parse(sf.RelayURL)
 	if err != nil {
 		return fmt.Errorf("invalid default relay url: %s", err)
 	}
 
-	if !namematcher.IsValidRule(sf.RelayDomainNamePattern) {
+	relayPatterns := sf.relayDomainNamePatterns()
+	if len(relayPatterns) == 0 {
 		return fmt.Errorf("invalid relay domain name pattern")
 	}
+	for _, pattern := range relayPatterns {
+		if !namematcher.IsValidRule(pattern) {
+			return fmt.Errorf("invalid relay domain name pattern %q", pattern)
+		}
+	}
+	if err := sf.checkRelayOverrides(sf.RelayURL); err != nil {
+		return err
+	}
+	if err := sf.checkRelayHeaders(); err != nil {
+		return err
+	}
+	if !sf.ClientIPMode.valid() {
+		return fmt.Errorf("invalid client IP mode %q", sf.ClientIPMode)
+	}
+	if sf.ForceRelayURL {
+		if err := checkIsRelayURLAcceptable(sf.relayDomainNamePatterns(), sf.AllowProxyingToPrivateAddresses, sf.AllowNonTLSRelay, true, sf.RelayURL); err != nil {
+			return fmt.Errorf("invalid forced relay url: %s", err)
+		}
+	}
 
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: strings.Split(sf.STUNURL, ","),
-			},
-		},
+	for _, address := range sf.outboundAddresses() {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid outbound address %q", address)
+		}
 	}
-	tokens = newTokens(sf.Capacity)
 
-	err = sf.checkNATType(config, sf.NATProbeURL)
-	if err != nil {
+	if err := sf.checkServeClientNATTypes(); err != nil {
+		return err
+	}
+
+	sf.config = webrtc.Configuration{
+		ICEServers: iceServers,
+	}
+	if sf.Certificate != nil {
+		if err := checkCertificate(sf.Certificate); err != nil {
+			return err
+		}
+		sf.config.Certificates = []webrtc.Certificate{*sf.Certificate}
+	}
+	sf.capacityLock.Lock()
+	if sf.TokenPool != nil {
+		sf.tokens = sf.TokenPool
+	} else {
+		sf.tokens = newTokens(sf.Capacity)
+	}
+	sf.capacityLock.Unlock()
+	sf.relayTokens = newRelayTokens(sf.RelayCapacity)
+
+	prevNATType := sf.getCurrentNATType()
+	natTypeDetermined := false
+	if sf.DisableNATProbe {
+		sf.logMsg(slog.LevelInfo, "NAT type probe disabled", slog.String("nat_type", NATUnknown))
+	} else if err = sf.checkNATType(sf.config, sf.NATProbeURL); err != nil {
 		// non-fatal error. Log it and continue
-		log.Printf(err.Error())
-		setCurrentNATType(NATUnknown)
+		sf.logMsg(slog.LevelError, err.Error(), slog.String("nat_type", NATUnknown))
+	} else {
+		natTypeDetermined = true
 	}
-	sf.EventDispatcher.OnNewSnowflakeEvent(&event.EventOnCurrentNATTypeDetermined{CurNATType: getCurrentNATType()})
+	sf.reportInitialNATType(prevNATType, natTypeDetermined)
 
 	NatRetestTask := task.Periodic{
 		Interval: sf.NATTypeMeasurementInterval,
 		Execute: func() error {
-			return sf.checkNATType(config, sf.NATProbeURL)
+			return sf.checkNATType(sf.config, sf.NATProbeURL)
 		},
 		// Not setting OnError would shut down the periodic task on error by default.
 		OnError: func(err error) {
-			log.Printf("Periodic probetest failed: %s, retaining current NAT type: %s", err.Error(), getCurrentNATType())
+			sf.logMsg(slog.LevelError, fmt.Sprintf("Periodic probetest failed: %s, retaining current NAT type: %s", err.Error(), sf.getCurrentNATType()),
+				slog.String("nat_type", sf.getCurrentNATType()))
 		},
 	}
 
-	if sf.NATTypeMeasurementInterval != 0 {
+	if sf.NATTypeMeasurementInterval != 0 && !sf.DisableNATProbe {
 		NatRetestTask.WaitThenStart()
 		defer NatRetestTask.Close()
 	}
 
-	ticker := time.NewTicker(sf.PollInterval)
+	// The proxy is running now, unless it was stopped while starting.
+	sf.state.CompareAndSwap(int32(StateStarting), int32(StateRunning))
+
+	clock := sf.getClock()
+	ticker := clock.NewTicker(sf.PollInterval)
 	defer ticker.Stop()
 
-	for ; true; <-ticker.C {
-		select {
-		case <-sf.shutdown:
+	for ; true; <-ticker.C() {
+		if sf.pollingStopped() {
+			return nil
+		}
+		if !sf.tokens.TryGet() {
+			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyAtCapacity{Capacity: sf.getCapacity(), Time: clock.Now()})
+			sf.tokens.Get()
+			sf.EventDispatcher.OnNewSnowflakeEvent(event.EventOnProxyBelowCapacity{Capacity: sf.getCapacity(), Time: clock.Now()})
+		}
+		// We may have been waiting for a token for a while.
+		if sf.pollingStopped() {
+			sf.tokens.Ret()
 			return nil
-		default:
-			tokens.get()
-			sessionID := genSessionID()
-			sf.runSession(sessionID)
+		}
+		sf.sessions.Add(1)
+		sessionID, err := sf.newSessionID()
+		if err != nil {
+			sf.logMsg(slog.LevelError, fmt.Sprintf("error generating session ID, skipping poll: %s", err))
+			sf.endSession()
+			continue
+		}
+		sf.runSession(sessionID)
+
+		// The ticker already waits for PollInterval; after failed polls,
+		// wait for the rest of the backoff as well.
+		if sf.pollFailures > 0 {
+			backoff := nextPollDelay(sf.PollInterval, sf.MaxPollBackoff, sf.pollFailures, sf.pollRetryAfter)
+			sf.logMsg(slog.LevelWarn, fmt.Sprintf("%d consecutive broker polls failed, next poll in %v", sf.pollFailures, backoff),
+				slog.Int("poll_failures", sf.pollFailures), slog.Duration("backoff", backoff))
+			select {
+			case <-clock.After(backoff - sf.PollInterval):
+			case <-sf.shutdown:
+				return nil
+			case <-sf.pollShutdown:
+				return nil
+			}
 		}
 	}
 	return nil
 }
 
-// Stop closes all existing connections and shuts down the Snowflake.
+// reportInitialNATType dispatches EventOnCurrentNATTypeDetermined once the
+// proxy's NAT type has been probed at startup, or the probe was skipped or
+// failed, in which case the NAT type becomes NATUnknown. prevNATType is the
+// NAT type before the probe.
+//
+// checkNATType only reports changes, but the listeners that Start installs,
+// such as the health check, need to learn the NAT type even when a restart
+// finds the same one as before.
+func (sf *SnowflakeProxy) reportInitialNATType(prevNATType string, determined bool) {
+	if !determined {
+		sf.setCurrentNATType(NATUnknown)
+	}
+	curNATType := sf.getCurrentNATType()
+	if determined && curNATType != prevNATType {
+		// checkNATType has reported the change.
+		return
+	}
+	sf.EventDispatcher.OnNewSnowflakeEvent(&event.EventOnCurrentNATTypeDetermined{
+		CurNATType:      curNATType,
+		PreviousNATType: prevNATType,
+	})
+}
+
+// getCurrentNATType returns the proxy's current NAT type.
+func (sf *SnowflakeProxy) getCurrentNATType() string {
+	sf.natTypeLock.RLock()
+	defer sf.natTypeLock.RUnlock()
+	if sf.natType == "" {
+		return NATUnknown
+	}
+	return sf.natType
+}
+
+// setCurrentNATType sets the proxy's current NAT type.
+func (sf *SnowflakeProxy) setCurrentNATType(newType string) {
+	sf.natTypeLock.Lock()
+	defer sf.natTypeLock.Unlock()
+	sf.natType = newType
+}
+
+// SetClock sets the Clock used by the poll loop and by sessions instead of the
+// time package. It is meant for tests, and must be called before Start.
+func (sf *SnowflakeProxy) SetClock(clock Clock) {
+	sf.clock = clock
+}
+
+// getClock returns the Clock set with SetClock, or one based on the time
+// package if none was set.
+func (sf *SnowflakeProxy) getClock() Clock {
+	if sf.clock == nil {
+		return realClock{}
+	}
+	return sf.clock
+}
+
+// pollingStopped reports whether the proxy should stop polling the broker
+// for new clients.
+func (sf *SnowflakeProxy) pollingStopped() bool {
+	select {
+	case <-sf.shutdown:
+		return true
+	case <-sf.pollShutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// endSession returns the token held by a session, once it failed to connect
+// or the connection is over.
+func (sf *SnowflakeProxy) endSession() {
+	sf.tokens.Ret()
+	sf.sessions.Done()
+}
+
+// endRelaySession is like endSession, for a session that also holds a token
+// for relayURL.
+func (sf *SnowflakeProxy) endRelaySession(relayURL string) {
+	sf.relayTokens.ret(relayURL)
+	sf.endSession()
+}
+
+// initChannels creates the channels used to stop the proxy, so that Stop and
+// Drain can be called before Start. If restart is set and a previous run of
+// the proxy has ended, they are replaced with new ones. It returns pollDone.
+func (sf *SnowflakeProxy) initChannels(restart bool) chan struct{} {
+	sf.runLock.Lock()
+	defer sf.runLock.Unlock()
+	if sf.pollDone == nil || (restart && isClosed(sf.pollDone)) {
+		sf.shutdown = make(chan struct{})
+		sf.pollShutdown = make(chan struct{})
+		sf.pollDone = make(chan struct{})
+	}
+	return sf.pollDone
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// State returns the current lifecycle state of the proxy. Once Start has
+// returned, it is StateStopped.
+func (sf *SnowflakeProxy) State() State {
+	return State(sf.state.Load())
+}
+
+// setStopping moves a starting or running proxy to StateStopping.
+func (sf *SnowflakeProxy) setStopping() {
+	if !sf.state.CompareAndSwap(int32(StateStarting), int32(StateStopping)) {
+		sf.state.CompareAndSwap(int32(StateRunning), int32(StateStopping))
+	}
+}
+
+// SetCapacity changes the maximum number of clients the proxy serves at once
+// to n, 0 meaning unlimited. It may be called while the proxy is running, and
+// resizes the token pool without dropping any connection. Raising the capacity
+// lets the proxy poll for new clients right away. Lowering it below the number
+// of clients currently served makes the proxy stop polling for new clients
+// until enough of the existing connections are over.
+func (sf *SnowflakeProxy) SetCapacity(n uint) {
+	sf.capacityLock.Lock()
+	defer sf.capacityLock.Unlock()
+	sf.Capacity = n
+	if sf.tokens != nil {
+		sf.tokens.Resize(n)
+	}
+}
+
+// activeSessions returns the number of clients being served.
+func (sf *SnowflakeProxy) activeSessions() int64 {
+	sf.capacityLock.Lock()
+	defer sf.capacityLock.Unlock()
+	if sf.tokens == nil {
+		return 0
+	}
+	return sf.tokens.Count()
+}
+
+func (sf *SnowflakeProxy) getCapacity() uint {
+	sf.capacityLock.Lock()
+	defer sf.capacityLock.Unlock()
+	return sf.Capacity
+}
+
+// Stop closes all existing connections and shuts down the Snowflake. It may
+// be called any number of times, including before the first Start, in which
+// case Start returns without polling the broker.
 func (sf *SnowflakeProxy) Stop() {
-	close(sf.shutdown)
+	sf.initChannels(false)
+	sf.setStopping()
+	sf.runLock.Lock()
+	defer sf.runLock.Unlock()
+	if !isClosed(sf.shutdown) {
+		close(sf.shutdown)
+	}
+}
+
+// Drain stops polling the broker for new clients and waits up to timeout for
+// the connections that are currently being served to finish. It then shuts
+// down the Snowflake as Stop does, closing any connections that remain.
+// An error is returned if the timeout elapsed before all connections finished.
+func (sf *SnowflakeProxy) Drain(timeout time.Duration) error {
+	pollDone := sf.initChannels(false)
+	sf.setStopping()
+	sf.runLock.Lock()
+	if !isClosed(sf.pollShutdown) {
+		close(sf.pollShutdown)
+	}
+	sf.runLock.Unlock()
+	deadline := time.After(timeout)
+
+	// Wait for the poll loop to exit first, so that no new session is
+	// added while we wait for existing ones.
+	done := make(chan struct{})
+	go func() {
+		<-pollDone
+		sf.sessions.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-deadline:
+		err = fmt.Errorf("connections still open after %v", timeout)
+	}
+	sf.Stop()
+	return err
+}
+
+// StopWithTimeout shuts down the Snowflake as Stop does, and waits up to
+// timeout for all the sessions to end. Should any session still be in
+// progress at the deadline, for example because it is stuck on a dead
+// connection, its connections are closed forcibly and an error is returned.
+func (sf *SnowflakeProxy) StopWithTimeout(timeout time.Duration) error {
+	pollDone := sf.initChannels(false)
+	sf.Stop()
+	deadline := time.After(timeout)
+
+	// As in Drain, wait for the poll loop to exit first, so that no new
+	// session is added while we wait for existing ones.
+	done := make(chan struct{})
+	go func() {
+		<-pollDone
+		sf.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-deadline:
+	}
+	closed := sf.activeConns.closeAll()
+	return fmt.Errorf("sessions still running after %v, closed %d connections", timeout, closed)
 }
 
 // checkNATType use probetest to determine NAT compatability by
 // attempting to connect with a known symmetric NAT. If success,
-// it is considered "unrestricted". If timeout it is considered "restricted"
+// it is considered "unrestricted". If timeout it is considered "restricted".
+// It records the duration and outcome of the probe for NATProbeStats, and
+// dispatches EventOnNATProbeCompleted.
 func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL string) error {
-	log.Printf("Checking our NAT type, contacting NAT check probe server at \"%v\"...", probeURL)
+	start := sf.getClock().Now()
+	err := sf.probeNATType(config, probeURL)
+	duration := sf.getClock().Now().Sub(start)
 
-	probe, err := newSignalingServer(probeURL)
+	sf.natProbeResults.add(duration, err == nil)
+	probeEvent := event.EventOnNATProbeCompleted{Duration: duration}
+	if err != nil {
+		probeEvent.Error = err.Error()
+	} else {
+		probeEvent.NATType = sf.getCurrentNATType()
+	}
+	sf.EventDispatcher.OnNewSnowflakeEvent(probeEvent)
+	return err
+}
+
+// NATProbeStats returns statistics about the most recent NAT type probes, to
+// help notice an unreliable probe server.
+func (sf *SnowflakeProxy) NATProbeStats() NATProbeStats {
+	return sf.natProbeResults.stats()
+}
+
+func (sf *SnowflakeProxy) probeNATType(config webrtc.Configuration, probeURL string) error {
+	sf.logMsg(slog.LevelInfo, fmt.Sprintf("Checking our NAT type, contacting NAT check probe server at \"%v\"...", probeURL))
+
+	probe, err := newSignalingServer(probeURL, sf.brokerTransport())
 	if err != nil {
 		return fmt.Errorf("Error parsing url: %w", err)
 	}
+	probe.logMsg = sf.logMsg
 
 	dataChan := make(chan struct{})
 	pc, err := sf.makeNewPeerConnection(config, dataChan)
@@ -819,12 +2220,12 @@ func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL str
 	}
 	defer func() {
 		if err := pc.Close(); err != nil {
-			log.Printf("Probetest: error calling pc.Close: %v", err)
+			sf.logMsg(slog.LevelError, fmt.Sprintf("Probetest: error calling pc.Close: %v", err))
 		}
 	}()
 
 	offer := pc.LocalDescription()
-	log.Printf("Probetest offer: \n\t%s", strings.ReplaceAll(offer.SDP, "\n", "\n\t"))
+	sf.logMsg(slog.LevelDebug, fmt.Sprintf("Probetest offer: \n\t%s", strings.ReplaceAll(offer.SDP, "\n", "\n\t")))
 	sdp, err := util.SerializeSessionDescription(offer)
 	if err != nil {
 		return fmt.Errorf("Error encoding probe message: %w", err)
@@ -836,7 +2237,7 @@ func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL str
 		return fmt.Errorf("Error encoding probe message: %w", err)
 	}
 
-	resp, err := probe.Post(probe.url.String(), bytes.NewBuffer(body))
+	resp, err := probe.Post(probe.url.String(), bytes.NewBuffer(body), nil)
 	if err != nil {
 		return fmt.Errorf("Error polling probe: %w", err)
 	}
@@ -850,34 +2251,42 @@ func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL str
 	if err != nil {
 		return fmt.Errorf("Error setting answer: %w", err)
 	}
-	log.Printf("Probetest answer: \n\t%s", strings.ReplaceAll(answer.SDP, "\n", "\n\t"))
+	sf.logMsg(slog.LevelDebug, fmt.Sprintf("Probetest answer: \n\t%s", strings.ReplaceAll(answer.SDP, "\n", "\n\t")))
 
 	err = pc.SetRemoteDescription(*answer)
 	if err != nil {
 		return fmt.Errorf("Error setting answer: %w", err)
 	}
 
-	prevNATType := getCurrentNATType()
+	prevNATType := sf.getCurrentNATType()
 
-	log.Printf("Waiting for a test WebRTC connection with NAT check probe server to establish...")
+	sf.logMsg(slog.LevelInfo, "Waiting for a test WebRTC connection with NAT check probe server to establish...")
 	select {
 	case <-dataChan:
-		log.Printf(
+		sf.logMsg(slog.LevelInfo, fmt.Sprintf(
 			"Test WebRTC connection with NAT check probe server established!"+
 				" This means our NAT is %v!",
 			NATUnrestricted,
-		)
-		setCurrentNATType(NATUnrestricted)
+		))
+		sf.setCurrentNATType(NATUnrestricted)
 	case <-time.After(dataChannelTimeout):
-		log.Printf(
+		sf.logMsg(slog.LevelInfo, fmt.Sprintf(
 			"Test WebRTC connection with NAT check probe server timed out."+
 				" This means our NAT is %v.",
 			NATRestricted,
-		)
-		setCurrentNATType(NATRestricted)
+		))
+		sf.setCurrentNATType(NATRestricted)
 	}
 
-	log.Printf("NAT Type measurement: %v -> %v\n", prevNATType, getCurrentNATType())
+	curNATType := sf.getCurrentNATType()
+	sf.logMsg(slog.LevelInfo, fmt.Sprintf("NAT Type measurement: %v -> %v", prevNATType, curNATType),
+		slog.String("nat_type", curNATType), slog.String("previous_nat_type", prevNATType))
+	if curNATType != prevNATType {
+		sf.EventDispatcher.OnNewSnowflakeEvent(&event.EventOnCurrentNATTypeDetermined{
+			CurNATType:      curNATType,
+			PreviousNATType: prevNATType,
+		})
+	}
 
 	return nil
 }
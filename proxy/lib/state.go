@@ -0,0 +1,35 @@
+package snowflake_proxy
+
+// State is the lifecycle state of a SnowflakeProxy, as returned by
+// SnowflakeProxy.State.
+type State int32
+
+const (
+	// StateStopped is the state of a proxy that has not been started, or
+	// whose Start has returned.
+	StateStopped State = iota
+	// StateStarting is the state of a proxy whose Start is checking its
+	// configuration and measuring its NAT type.
+	StateStarting
+	// StateRunning is the state of a proxy that is polling the broker for
+	// clients.
+	StateRunning
+	// StateStopping is the state of a proxy that has been stopped or is
+	// draining, but whose Start has not returned yet.
+	StateStopping
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,139 @@
+package snowflake_proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/event"
+)
+
+// proxyStatus is the JSON document served by the status server.
+type proxyStatus struct {
+	NATType string `json:"nat_type"`
+	// ActiveSessions counts the clients being served, including those the
+	// proxy is still waiting for, and ActiveConnections only those whose
+	// data channel is open.
+	ActiveSessions    int64 `json:"active_sessions"`
+	ActiveConnections int64 `json:"active_connections"`
+	// InboundBytes and OutboundBytes are the totals relayed since the
+	// proxy started.
+	InboundBytes  int64 `json:"inbound_bytes"`
+	OutboundBytes int64 `json:"outbound_bytes"`
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	// LastPollSuccess is the time of the last successful poll to the
+	// broker, if any.
+	LastPollSuccess *time.Time `json:"last_poll_success,omitempty"`
+}
+
+// statusServer is an event listener that serves the live status of the proxy
+// as JSON over HTTP. It is also the BytesLogger of the proxy's connections, to
+// count the total traffic, and passes the traffic on to the proxy's own
+// BytesLogger.
+type statusServer struct {
+	lock              sync.Mutex
+	natType           string
+	activeConnections int64
+	lastPollSuccess   time.Time
+
+	start    time.Time
+	sessions func() int64
+
+	bytesLogger       BytesLogger
+	inbound, outbound atomic.Int64
+
+	server *http.Server
+}
+
+// newStatusServer returns a statusServer that passes traffic on to
+// bytesLogger, and gets the number of active sessions from sessions.
+func newStatusServer(bytesLogger BytesLogger, sessions func() int64) *statusServer {
+	return &statusServer{
+		natType:     NATUnknown,
+		start:       time.Now(),
+		sessions:    sessions,
+		bytesLogger: bytesLogger,
+	}
+}
+
+func (s *statusServer) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch e := e.(type) {
+	case *event.EventOnCurrentNATTypeDetermined:
+		s.natType = e.CurNATType
+	case event.EventOnProxyPollSucceeded:
+		s.lastPollSuccess = time.Now()
+	case event.EventOnProxyConnectionStarted:
+		s.activeConnections++
+	case event.EventOnProxyConnectionOver:
+		s.activeConnections--
+	}
+}
+
+func (s *statusServer) AddInbound(amount int64) {
+	s.inbound.Add(amount)
+	s.bytesLogger.AddInbound(amount)
+}
+
+func (s *statusServer) AddOutbound(amount int64) {
+	s.outbound.Add(amount)
+	s.bytesLogger.AddOutbound(amount)
+}
+
+func (s *statusServer) GetStat() (in int64, out int64) {
+	return s.bytesLogger.GetStat()
+}
+
+func (s *statusServer) status() proxyStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := proxyStatus{
+		NATType:           s.natType,
+		ActiveSessions:    s.sessions(),
+		ActiveConnections: s.activeConnections,
+		InboundBytes:      s.inbound.Load(),
+		OutboundBytes:     s.outbound.Load(),
+		UptimeSeconds:     int64(time.Since(s.start).Seconds()),
+	}
+	if !s.lastPollSuccess.IsZero() {
+		lastPollSuccess := s.lastPollSuccess.UTC()
+		status.LastPollSuccess = &lastPollSuccess
+	}
+	return status
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+// Start serves the status on the given address.
+func (s *statusServer) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/status", s)
+	s.server = &http.Server{Handler: mux}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the status server.
+func (s *statusServer) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
@@ -1,44 +1,110 @@
 package snowflake_proxy
 
 import (
-	"sync/atomic"
+	"sync"
 )
 
+// TokenPool limits the number of clients that the proxy serves at once. Each
+// client holds a token while it is served.
+type TokenPool interface {
+	// Get takes a token, blocking until one is available.
+	Get()
+	// TryGet is like Get, but returns false instead of blocking when no
+	// token is available.
+	TryGet() bool
+	// Ret returns a token taken by Get or TryGet.
+	Ret()
+	// Count returns the number of tokens taken.
+	Count() int64
+	// Resize changes the number of tokens to n, 0 meaning unlimited. Tokens
+	// already taken stay valid, even beyond n.
+	Resize(n uint)
+}
+
+// tokens_t is the default TokenPool, with a fixed number of tokens set by
+// SnowflakeProxy.Capacity, unless it is resized.
 type tokens_t struct {
-	ch       chan struct{}
+	lock     sync.Mutex
+	cond     *sync.Cond // signaled when a token is returned or added
 	capacity uint
 	clients  int64
 }
 
 func newTokens(capacity uint) *tokens_t {
-	var ch chan struct{}
-	if capacity != 0 {
-		ch = make(chan struct{}, capacity)
+	t := &tokens_t{capacity: capacity}
+	t.cond = sync.NewCond(&t.lock)
+	return t
+}
+
+// available reports whether a token can be taken. t.lock must be held.
+func (t *tokens_t) available() bool {
+	return t.capacity == 0 || t.clients < int64(t.capacity)
+}
+
+func (t *tokens_t) Get() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for !t.available() {
+		t.cond.Wait()
 	}
+	t.clients++
+}
 
-	return &tokens_t{
-		ch:       ch,
-		capacity: capacity,
-		clients:  0,
+func (t *tokens_t) TryGet() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.available() {
+		return false
 	}
+	t.clients++
+	return true
 }
 
-func (t *tokens_t) get() {
-	atomic.AddInt64(&t.clients, 1)
+func (t *tokens_t) Ret() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.clients--
+	t.cond.Signal()
+}
 
-	if t.capacity != 0 {
-		t.ch <- struct{}{}
-	}
+func (t *tokens_t) Count() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.clients
+}
+
+func (t *tokens_t) Resize(n uint) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.capacity = n
+	t.cond.Broadcast()
 }
 
-func (t *tokens_t) ret() {
-	atomic.AddInt64(&t.clients, -1)
+// relayTokens holds a separate tokens_t for each relay URL that has its own
+// capacity, so that clients of one relay cannot take up all of the proxy's
+// capacity. Clients of other relays are only limited by the global tokens.
+type relayTokens map[string]*tokens_t
 
-	if t.capacity != 0 {
-		<-t.ch
+func newRelayTokens(capacities map[string]uint) relayTokens {
+	t := make(relayTokens, len(capacities))
+	for relayURL, capacity := range capacities {
+		t[relayURL] = newTokens(capacity)
 	}
+	return t
 }
 
-func (t tokens_t) count() int64 {
-	return atomic.LoadInt64(&t.clients)
+// tryGet takes a token for relayURL without blocking, and returns false if
+// none is available.
+func (t relayTokens) tryGet(relayURL string) bool {
+	if tokens, ok := t[relayURL]; ok {
+		return tokens.TryGet()
+	}
+	return true
+}
+
+// ret returns a token taken for relayURL.
+func (t relayTokens) ret(relayURL string) {
+	if tokens, ok := t[relayURL]; ok {
+		tokens.Ret()
+	}
 }
@@ -9,20 +9,71 @@ import (
 func TestTokens(t *testing.T) {
 	Convey("Tokens", t, func() {
 		tokens := newTokens(2)
-		So(tokens.count(), ShouldEqual, 0)
-		tokens.get()
-		So(tokens.count(), ShouldEqual, 1)
-		tokens.ret()
-		So(tokens.count(), ShouldEqual, 0)
+		So(tokens.Count(), ShouldEqual, 0)
+		tokens.Get()
+		So(tokens.Count(), ShouldEqual, 1)
+		tokens.Ret()
+		So(tokens.Count(), ShouldEqual, 0)
 	})
 	Convey("Tokens capacity 0", t, func() {
 		tokens := newTokens(0)
-		So(tokens.count(), ShouldEqual, 0)
+		So(tokens.Count(), ShouldEqual, 0)
 		for i := 0; i < 20; i++ {
-			tokens.get()
+			tokens.Get()
 		}
-		So(tokens.count(), ShouldEqual, 20)
-		tokens.ret()
-		So(tokens.count(), ShouldEqual, 19)
+		So(tokens.Count(), ShouldEqual, 20)
+		tokens.Ret()
+		So(tokens.Count(), ShouldEqual, 19)
+	})
+	Convey("Tokens TryGet", t, func() {
+		tokens := newTokens(1)
+		So(tokens.TryGet(), ShouldBeTrue)
+		So(tokens.TryGet(), ShouldBeFalse)
+		So(tokens.Count(), ShouldEqual, 1)
+		tokens.Ret()
+		So(tokens.TryGet(), ShouldBeTrue)
+
+		unlimited := newTokens(0)
+		So(unlimited.TryGet(), ShouldBeTrue)
+		So(unlimited.TryGet(), ShouldBeTrue)
+		So(unlimited.Count(), ShouldEqual, 2)
+	})
+	Convey("Tokens Resize", t, func() {
+		var tokens TokenPool = newTokens(1)
+		tokens.Get()
+		So(tokens.TryGet(), ShouldBeFalse)
+
+		tokens.Resize(2)
+		So(tokens.TryGet(), ShouldBeTrue)
+		So(tokens.TryGet(), ShouldBeFalse)
+
+		// Raising the capacity wakes up a blocked Get.
+		done := make(chan struct{})
+		go func() {
+			tokens.Get()
+			close(done)
+		}()
+		tokens.Resize(3)
+		<-done
+		So(tokens.Count(), ShouldEqual, 3)
+
+		// Lowering the capacity keeps the tokens already taken.
+		tokens.Resize(1)
+		So(tokens.Count(), ShouldEqual, 3)
+		tokens.Ret()
+		tokens.Ret()
+		So(tokens.TryGet(), ShouldBeFalse)
+		tokens.Ret()
+		So(tokens.TryGet(), ShouldBeTrue)
+	})
+	Convey("Relay tokens", t, func() {
+		relayTokens := newRelayTokens(map[string]uint{"wss://a.example/": 1})
+		So(relayTokens.tryGet("wss://a.example/"), ShouldBeTrue)
+		So(relayTokens.tryGet("wss://a.example/"), ShouldBeFalse)
+		So(relayTokens.tryGet("wss://b.example/"), ShouldBeTrue)
+		So(relayTokens.tryGet("wss://b.example/"), ShouldBeTrue)
+		relayTokens.ret("wss://b.example/")
+		relayTokens.ret("wss://a.example/")
+		So(relayTokens.tryGet("wss://a.example/"), ShouldBeTrue)
 	})
 }
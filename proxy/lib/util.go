@@ -4,15 +4,22 @@ import (
 	"time"
 )
 
-// bytesLogger is an interface which is used to allow logging the throughput
-// of the Snowflake. A default bytesLogger(bytesNullLogger) does nothing.
-type bytesLogger interface {
+// BytesLogger is an interface which is used to allow logging the throughput
+// of the Snowflake. A default BytesLogger(bytesNullLogger) does nothing.
+//
+// Implementations must be safe for concurrent use, as every connection
+// reports its traffic to the same BytesLogger.
+type BytesLogger interface {
+	// AddOutbound adds a number of bytes received from a client.
 	AddOutbound(int64)
+	// AddInbound adds a number of bytes sent to a client.
 	AddInbound(int64)
+	// GetStat returns the inbound and outbound totals since the last call
+	// to GetStat, and then zeros them.
 	GetStat() (in int64, out int64)
 }
 
-// bytesNullLogger Default bytesLogger does nothing.
+// bytesNullLogger Default BytesLogger does nothing.
 type bytesNullLogger struct{}
 
 // AddOutbound in bytesNullLogger does nothing
@@ -84,3 +91,14 @@ func (b *bytesSyncLogger) GetStat() (in int64, out int64) {
 }
 
 func formatTraffic(amount int64) (value int64, unit string) { return amount / 1000, "KB" }
+
+// trafficRatio returns how many times more bytes went in the busier direction
+// of a connection than in the other one, or 0 if there was no traffic. A
+// direction without traffic counts as one byte.
+func trafficRatio(inbound, outbound int64) float64 {
+	larger, smaller := max(inbound, outbound), min(inbound, outbound)
+	if larger <= 0 {
+		return 0
+	}
+	return float64(larger) / float64(max(smaller, 1))
+}
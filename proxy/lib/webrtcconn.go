@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/ice/v4"
@@ -33,19 +35,28 @@ type webRTCConn struct {
 	lock sync.Mutex // Synchronization for DataChannel destruction
 	once sync.Once  // Synchronization for PeerConnection destruction
 
-	isClosing bool
+	// closed is closed by Close, to unblock a Write waiting for the data
+	// channel's buffered amount to go down.
+	closed chan struct{}
 
 	inactivityTimeout time.Duration
 	activity          chan struct{}
+	// sendMoreCh is signaled when the data channel's buffered amount drops
+	// to its low threshold.
 	sendMoreCh        chan struct{}
 	cancelTimeoutLoop context.CancelFunc
 
-	bytesLogger bytesLogger
+	bytesLogger BytesLogger
+	// logMsg logs the connection's messages.
+	logMsg logFunc
+	// inboundBytes and outboundBytes count the traffic of this connection
+	// alone, whereas bytesLogger aggregates the traffic of all connections.
+	inboundBytes, outboundBytes atomic.Int64
 }
 
-func newWebRTCConn(pc *webrtc.PeerConnection, dc *webrtc.DataChannel, pr *io.PipeReader, bytesLogger bytesLogger) *webRTCConn {
-	conn := &webRTCConn{pc: pc, dc: dc, pr: pr, bytesLogger: bytesLogger}
-	conn.isClosing = false
+func newWebRTCConn(pc *webrtc.PeerConnection, dc *webrtc.DataChannel, pr *io.PipeReader, bytesLogger BytesLogger, logMsg logFunc) *webRTCConn {
+	conn := &webRTCConn{pc: pc, dc: dc, pr: pr, bytesLogger: bytesLogger, logMsg: logMsg}
+	conn.closed = make(chan struct{})
 	conn.activity = make(chan struct{}, 100)
 	conn.sendMoreCh = make(chan struct{}, 1)
 	conn.inactivityTimeout = 30 * time.Second
@@ -61,7 +72,7 @@ func (c *webRTCConn) timeoutLoop(ctx context.Context) {
 		select {
 		case <-timer.C:
 			_ = c.Close()
-			log.Println("Closed connection due to inactivity")
+			c.logMsg(slog.LevelInfo, "Closed connection due to inactivity")
 			return
 		case <-c.activity:
 			if !timer.Stop() {
@@ -80,35 +91,61 @@ func (c *webRTCConn) Read(b []byte) (int, error) {
 }
 
 func (c *webRTCConn) Write(b []byte) (int, error) {
-	c.bytesLogger.AddInbound(int64(len(b)))
 	select {
 	case c.activity <- struct{}{}:
 	default:
 	}
+	if err := c.waitForBufferedAmountLow(); err != nil {
+		return 0, err
+	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if c.dc != nil {
-		_ = c.dc.Send(b)
-		if !c.isClosing && c.dc.BufferedAmount() >= maxBufferedAmount {
-			<-c.sendMoreCh
-		}
+	// Only count the bytes that were actually sent to the client.
+	if c.dc != nil && c.dc.Send(b) == nil {
+		c.bytesLogger.AddInbound(int64(len(b)))
+		c.inboundBytes.Add(int64(len(b)))
 	}
 	return len(b), nil
 }
 
-func (c *webRTCConn) Close() (err error) {
-	c.isClosing = true
-	select {
-	case c.sendMoreCh <- struct{}{}:
-	default:
+// waitForBufferedAmountLow blocks while the data channel has maxBufferedAmount
+// bytes or more buffered, until OnBufferedAmountLow signals sendMoreCh. This
+// pauses the copy from the relay when the client cannot keep up, so that the
+// data buffered for it stays bounded. The lock is not held while waiting, so
+// that the data channel can still be closed. It returns io.ErrClosedPipe if c
+// is closed while waiting.
+func (c *webRTCConn) waitForBufferedAmountLow() error {
+	for {
+		c.lock.Lock()
+		high := c.dc != nil && c.dc.BufferedAmount() >= maxBufferedAmount
+		c.lock.Unlock()
+		if !high {
+			return nil
+		}
+		// A signal left over from earlier is harmless, because the
+		// buffered amount is checked again.
+		select {
+		case <-c.sendMoreCh:
+		case <-c.closed:
+			return io.ErrClosedPipe
+		}
 	}
+}
+
+func (c *webRTCConn) Close() (err error) {
 	c.once.Do(func() {
+		close(c.closed)
 		c.cancelTimeoutLoop()
 		err = errors.Join(c.pr.Close(), c.pc.Close())
 	})
 	return
 }
 
+// GetStat returns the number of bytes relayed over this connection so far.
+func (c *webRTCConn) GetStat() (in int64, out int64) {
+	return c.inboundBytes.Load(), c.outboundBytes.Load()
+}
+
 func (c *webRTCConn) LocalAddr() net.Addr {
 	return nil
 }
@@ -175,3 +212,88 @@ func remoteIPFromSDP(str string) net.IP {
 
 	return nil
 }
+
+// checkOffer returns an error if offer is not a sane client offer: larger than
+// maxSize bytes (unless maxSize is 0), not parseable, or without a data channel
+// and the ICE and DTLS attributes needed to connect to it.
+func checkOffer(offer *webrtc.SessionDescription, maxSize uint) error {
+	if offer.Type != webrtc.SDPTypeOffer {
+		return fmt.Errorf("unexpected SDP type %v", offer.Type)
+	}
+	if maxSize != 0 && uint(len(offer.SDP)) > maxSize {
+		return fmt.Errorf("offer of %d bytes exceeds maximum of %d bytes", len(offer.SDP), maxSize)
+	}
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer.SDP)); err != nil {
+		return fmt.Errorf("error parsing offer: %w", err)
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return fmt.Errorf("offer has no media description")
+	}
+	var application *sdp.MediaDescription
+	for _, m := range desc.MediaDescriptions {
+		if m.MediaName.Media == "application" {
+			application = m
+			break
+		}
+	}
+	if application == nil {
+		return fmt.Errorf("offer has no application media description")
+	}
+	// These attributes may be at the session or the media level.
+	for _, key := range []string{"ice-ufrag", "ice-pwd", "fingerprint"} {
+		_, inSession := desc.Attribute(key)
+		_, inMedia := application.Attribute(key)
+		if !inSession && !inMedia {
+			return fmt.Errorf("offer has no %s attribute", key)
+		}
+	}
+	return nil
+}
+
+// hasServerReflexiveCandidate reports whether the SDP contains at least one
+// server reflexive ICE candidate.
+func hasServerReflexiveCandidate(str string) bool {
+	var desc sdp.SessionDescription
+	err := desc.Unmarshal([]byte(str))
+	if err != nil {
+		return false
+	}
+	for _, m := range desc.MediaDescriptions {
+		for _, a := range m.Attributes {
+			if a.IsICECandidate() {
+				c, err := ice.UnmarshalCandidate(a.Value)
+				if err == nil && c.Type() == ice.CandidateTypeServerReflexive {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// filterCandidates returns the SDP str without the ICE candidates for which
+// keep returns false. keep is passed each candidate in the form
+// "candidate:<foundation> <component> ...", as in an a=candidate: line.
+func filterCandidates(str string, keep func(candidate string) bool) string {
+	var desc sdp.SessionDescription
+	err := desc.Unmarshal([]byte(str))
+	if err != nil {
+		return str
+	}
+	for _, m := range desc.MediaDescriptions {
+		attrs := make([]sdp.Attribute, 0, len(m.Attributes))
+		for _, a := range m.Attributes {
+			if a.IsICECandidate() && !keep("candidate:"+a.Value) {
+				continue
+			}
+			attrs = append(attrs, a)
+		}
+		m.Attributes = attrs
+	}
+	bts, err := desc.Marshal()
+	if err != nil {
+		return str
+	}
+	return string(bts)
+}
@@ -0,0 +1,32 @@
+package snowflake_proxy
+
+import (
+	"io"
+	"time"
+)
+
+// writeDeadliner is a connection whose writes can be given a deadline, such
+// as a net.Conn or a websocketconn.Conn.
+type writeDeadliner interface {
+	io.ReadWriteCloser
+	SetWriteDeadline(t time.Time) error
+}
+
+// writeTimeoutConn fails writes to the wrapped connection that do not complete
+// within timeout, so that copyLoop gives up on a stalled peer instead of
+// blocking until the connection is closed some other way.
+type writeTimeoutConn struct {
+	writeDeadliner
+	timeout time.Duration
+}
+
+func newWriteTimeoutConn(conn writeDeadliner, timeout time.Duration) *writeTimeoutConn {
+	return &writeTimeoutConn{writeDeadliner: conn, timeout: timeout}
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.writeDeadliner.Write(b)
+}
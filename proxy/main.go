@@ -32,17 +32,21 @@ func main() {
 	defaultRelayURL := flag.String("relay", sf.DefaultRelayURL, "The default `URL` of the server (relay) that this proxy will forward client connections to, in case the broker itself did not specify the said URL")
 	probeURL := flag.String("nat-probe-server", sf.DefaultNATProbeURL, "The `URL` of the server that this proxy will use to check its network NAT type.\nDetermining NAT type helps to understand whether this proxy is compatible with certain clients' NAT")
 	outboundAddress := flag.String("outbound-address", "", "prefer the given `address` as outbound address for client connections")
-	allowedRelayHostNamePattern := flag.String("allowed-relay-hostname-pattern", "snowflake.torproject.net$", "this proxy will only be allowed to forward client connections to relays (servers) whose URL matches this pattern.\nNote that a pattern \"example.com$\" will match \"subdomain.example.com\" as well as \"other-domain-example.com\".\nIn order to only match \"example.com\", prefix the pattern with \"^\": \"^example.com$\"")
+	allowedRelayHostNamePattern := flag.String("allowed-relay-hostname-pattern", sf.DefaultRelayDomainNamePattern, "this proxy will only be allowed to forward client connections to relays (servers) whose URL matches this pattern.\nNote that a pattern \"example.com$\" will match \"subdomain.example.com\" as well as \"other-domain-example.com\".\nIn order to only match \"example.com\", prefix the pattern with \"^\": \"^example.com$\"")
 	allowProxyingToPrivateAddresses := flag.Bool("allow-proxying-to-private-addresses", false, "allow forwarding client connections to private IP addresses.\nUseful when a Snowflake server (relay) is hosted on the same private network as this proxy.")
 	allowNonTLSRelay := flag.Bool("allow-non-tls-relay", false, "allow this proxy to pass client's data to the relay in an unencrypted form.\nThis is only useful if the relay doesn't support encryption, e.g. for testing / development purposes.")
 	NATTypeMeasurementInterval := flag.Duration("nat-retest-interval", time.Hour*24,
 		"the time interval between NAT type is retests (see \"nat-probe-server\"). 0s disables retest. Valid time units are \"s\", \"m\", \"h\".")
 	summaryInterval := flag.Duration("summary-interval", time.Hour,
 		"the time interval between summary log outputs, 0s disables summaries. Valid time units are \"s\", \"m\", \"h\".")
+	clientIPMode := flag.String("client-ip-mode", string(sf.ClientIPFull), "how to pass the client's IP address to the relay: \"full\", \"truncated\" (only the /24 or /48 network) or \"none\"")
+	disableNATProbe := flag.Bool("disable-nat-probe", false, "do not check this proxy's NAT type (see \"nat-probe-server\"); it is then reported as unknown")
 	disableStatsLogger := flag.Bool("disable-stats-logger", false, "disable the exposing mechanism for stats using logs")
 	enableMetrics := flag.Bool("metrics", false, "enable the exposing mechanism for stats using metrics")
 	metricsAddress := flag.String("metrics-address", "localhost", "set listen `address` for metrics service")
 	metricsPort := flag.Int("metrics-port", 9999, "set port for the metrics service")
+	healthAddress := flag.String("health-address", "", "serve a health check on `address` (host:port), under the path /health")
+	statusAddress := flag.String("status-address", "", "serve the proxy's live status as JSON on `address` (host:port), under the path /status")
 	verboseLogging := flag.Bool("verbose", false, "increase log verbosity")
 	ephemeralPortsRangeFlag := flag.String("ephemeral-ports-range", "", "Set the `range` of ports used for client connections (format:\"<min>:<max>\").\nIf omitted, the ports will be chosen automatically.")
 	versionFlag := flag.Bool("version", false, "display version info to stderr and quit")
@@ -105,6 +109,8 @@ func main() {
 		EphemeralMaxPort:   ephemeralPortsRange[1],
 
 		NATTypeMeasurementInterval: *NATTypeMeasurementInterval,
+		DisableNATProbe:            *disableNATProbe,
+		ClientIPMode:               sf.ClientIPMode(*clientIPMode),
 		EventDispatcher:            eventLogger,
 
 		RelayDomainNamePattern:          *allowedRelayHostNamePattern,
@@ -151,16 +157,12 @@ func main() {
 	eventLogger.AddSnowflakeEventListener(proxyEventLogger)
 
 	if *enableMetrics {
-		metrics := sf.NewMetrics()
-
-		err := metrics.Start(net.JoinHostPort(*metricsAddress, strconv.Itoa(*metricsPort)))
-		if err != nil {
-			log.Fatalf("could not enable metrics: %v", err)
-		}
-
-		eventLogger.AddSnowflakeEventListener(sf.NewEventMetrics(metrics))
+		proxy.MetricsListenAddr = net.JoinHostPort(*metricsAddress, strconv.Itoa(*metricsPort))
 	}
 
+	proxy.HealthListenAddr = *healthAddress
+	proxy.StatusListenAddr = *statusAddress
+
 	log.Printf("snowflake-proxy %s\n", version.GetVersion())
 
 	err := proxy.Start()
@@ -108,6 +108,7 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Pass the address of client as the remote address of incoming connection
 	clientIPParam := r.URL.Query().Get("client_ip")
 	addr := clientAddr(clientIPParam)
+	origin := connOrigin(r)
 
 	var token [len(turbotunnel.Token)]byte
 	_, err = io.ReadFull(conn, token[:])
@@ -123,7 +124,7 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case bytes.Equal(token[:], turbotunnel.Token[:]):
-		err = handler.turbotunnelMode(conn, addr)
+		err = handler.turbotunnelMode(conn, addr, origin)
 	default:
 		// We didn't find a matching token, which means that we are
 		// dealing with a client that doesn't know about such things.
@@ -140,8 +141,9 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // turbotunnelMode handles clients that sent turbotunnel.Token at the start of
 // their stream. These clients expect to send and receive encapsulated packets,
-// with a long-lived session identified by ClientID.
-func (handler *httpHandler) turbotunnelMode(conn net.Conn, addr net.Addr) error {
+// with a long-lived session identified by ClientID. origin is how the
+// WebSocket connection reached the server.
+func (handler *httpHandler) turbotunnelMode(conn net.Conn, addr net.Addr, origin ConnOrigin) error {
 	// Read the ClientID prefix. Every packet encapsulated in this WebSocket
 	// connection pertains to the same ClientID.
 	var clientID turbotunnel.ClientID
@@ -158,8 +160,9 @@ func (handler *httpHandler) turbotunnelMode(conn net.Conn, addr net.Addr) error
 	// streams. We apply the heuristic that the IP address of the most
 	// recent WebSocket connection that has had to do with a session, at the
 	// time the session is established, is the IP address that should be
-	// credited for the entire KCP session.
-	clientIDAddrMap.Set(clientID, addr)
+	// credited for the entire KCP session. The same goes for the origin of
+	// the connection.
+	clientIDAddrMap.Set(clientID, originAddr{Addr: addr, origin: origin})
 
 	pconn := handler.lookupPacketConn(clientID)
 
@@ -221,6 +224,55 @@ func (handler *httpHandler) turbotunnelMode(conn net.Conn, addr net.Addr) error
 	return nil
 }
 
+// ConnOrigin is how a WebSocket connection reached the server.
+type ConnOrigin int
+
+const (
+	// OriginDirect is a connection made directly to the server.
+	OriginDirect ConnOrigin = iota
+	// OriginFronted is a connection that reached the server through a
+	// domain-fronting CDN or other reverse proxy.
+	OriginFronted
+)
+
+func (origin ConnOrigin) String() string {
+	switch origin {
+	case OriginDirect:
+		return "direct"
+	case OriginFronted:
+		return "fronted"
+	default:
+		return "unknown"
+	}
+}
+
+// frontingHeaders are request headers that CDNs and reverse proxies add when
+// they forward a request.
+var frontingHeaders = []string{
+	"Cdn-Loop",
+	"Forwarded",
+	"Via",
+	"X-Forwarded-For",
+}
+
+// connOrigin classifies the WebSocket request r as fronted if it carries any
+// of the headers that a forwarding CDN adds, and as direct otherwise.
+func connOrigin(r *http.Request) ConnOrigin {
+	for _, header := range frontingHeaders {
+		if r.Header.Get(header) != "" {
+			return OriginFronted
+		}
+	}
+	return OriginDirect
+}
+
+// originAddr is what turbotunnelMode stores in clientIDAddrMap: a client
+// address together with the origin of the WebSocket connection it came from.
+type originAddr struct {
+	net.Addr
+	origin ConnOrigin
+}
+
 // ClientMapAddr is a string that represents a connecting client.
 type ClientMapAddr string
 
@@ -2,6 +2,7 @@ package snowflake_server
 
 import (
 	"net"
+	"net/http"
 	"strconv"
 	"testing"
 
@@ -53,3 +54,17 @@ func TestClientAddr(t *testing.T) {
 		}
 	})
 }
+
+func TestConnOrigin(t *testing.T) {
+	Convey("Testing connOrigin", t, func() {
+		r, err := http.NewRequest("GET", "https://snowflake.example/", nil)
+		So(err, ShouldBeNil)
+		So(connOrigin(r), ShouldEqual, OriginDirect)
+
+		for _, header := range frontingHeaders {
+			r.Header = http.Header{}
+			r.Header.Set(header, "1.2.3.4")
+			So(connOrigin(r), ShouldEqual, OriginFronted)
+		}
+	})
+}
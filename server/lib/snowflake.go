@@ -210,8 +210,12 @@ func (l *SnowflakeListener) Close() error {
 func (l *SnowflakeListener) acceptStreams(conn *kcp.UDPSession) error {
 	// Look up the IP address associated with this KCP session, via the
 	// ClientID that is returned by the session's RemoteAddr method.
-	addr, ok := clientIDAddrMap.Get(conn.RemoteAddr().(turbotunnel.ClientID))
-	if !ok {
+	var addr net.Addr
+	var origin ConnOrigin
+	entry, ok := clientIDAddrMap.Get(conn.RemoteAddr().(turbotunnel.ClientID))
+	if ok {
+		addr, origin = entry.(originAddr).Addr, entry.(originAddr).origin
+	} else {
 		// This means that the map is tending to run over capacity, not
 		// just that there was not client_ip on the incoming connection.
 		// We store "" in the map in the absence of client_ip. This log
@@ -236,7 +240,7 @@ func (l *SnowflakeListener) acceptStreams(conn *kcp.UDPSession) error {
 			}
 			return err
 		}
-		l.queueConn(&SnowflakeClientConn{stream: stream, address: addr})
+		l.queueConn(&SnowflakeClientConn{stream: stream, address: addr, origin: origin})
 	}
 }
 
@@ -291,6 +295,7 @@ func (l *SnowflakeListener) queueConn(conn net.Conn) error {
 type SnowflakeClientConn struct {
 	stream  *smux.Stream
 	address net.Addr
+	origin  ConnOrigin
 }
 
 // Forward net.Conn methods, other than RemoteAddr, to the inner stream.
@@ -312,6 +317,12 @@ func (conn *SnowflakeClientConn) RemoteAddr() net.Addr {
 	return conn.address
 }
 
+// Origin returns how the most recent WebSocket connection of the client's
+// session, at the time the session was established, reached the server.
+func (conn *SnowflakeClientConn) Origin() ConnOrigin {
+	return conn.origin
+}
+
 // WriteTo implements the io.WriterTo interface by passing the call to the
 // underlying smux.Stream.
 func (conn *SnowflakeClientConn) WriteTo(w io.Writer) (int64, error) {
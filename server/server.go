@@ -17,7 +17,9 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/version"
 	"golang.org/x/crypto/acme/autocert"
@@ -73,7 +75,11 @@ func proxy(local *net.TCPConn, conn net.Conn) {
 // when dialing the ORPOrt.
 func handleConn(conn net.Conn, orPortSrcAddr *net.IPNet) error {
 	addr := conn.RemoteAddr().String()
-	statsChannel <- addr != ""
+	origin := sf.OriginDirect
+	if conn, ok := conn.(*sf.SnowflakeClientConn); ok {
+		origin = conn.Origin()
+	}
+	stats.recordConnection(addr, origin)
 
 	dialer := net.Dialer{
 		Control: dialerControl,
@@ -131,7 +137,10 @@ func main() {
 	var acmeEmail string
 	var acmeHostnamesCommas string
 	var disableTLS bool
+	var geoipDatabase string
+	var geoip6Database string
 	var logFilename string
+	var statsInterval time.Duration
 	var unsafeLogging bool
 	var versionFlag bool
 
@@ -139,7 +148,10 @@ func main() {
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
 	flag.StringVar(&acmeHostnamesCommas, "acme-hostnames", "", "comma-separated hostnames for TLS certificate")
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
+	flag.StringVar(&geoipDatabase, "geoipdb", "/usr/share/tor/geoip", "path to correctly formatted geoip database mapping IPv4 address ranges to country codes")
+	flag.StringVar(&geoip6Database, "geoip6db", "/usr/share/tor/geoip6", "path to correctly formatted geoip database mapping IPv6 address ranges to country codes")
 	flag.StringVar(&logFilename, "log", "", "log file to write to")
+	flag.DurationVar(&statsInterval, "stats-interval", defaultStatsInterval, "how often to log connection statistics")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
 	flag.BoolVar(&versionFlag, "version", false, "display version info to stderr and quit")
 	flag.Parse()
@@ -182,7 +194,19 @@ func main() {
 	}
 	pt.ReportVersion("snowflake-server", version.GetVersion())
 
-	go statsThread()
+	var geoipdb *geoip.Geoip
+	if geoipDatabase != "" || geoip6Database != "" {
+		geoipdb, err = geoip.New(geoipDatabase, geoip6Database)
+		if err != nil {
+			log.Printf("error loading geoip databases, client countries will be unknown: %s", err)
+			geoipdb = nil
+		}
+	}
+	if statsInterval <= 0 {
+		log.Fatalf("invalid stats interval %v: must be positive", statsInterval)
+	}
+	stats = newServerStats(geoipdb)
+	go statsThread(stats, statsInterval)
 
 	var certManager *autocert.Manager
 	if !disableTLS {
@@ -336,4 +360,6 @@ func main() {
 	for _, ln := range listeners {
 		ln.Close()
 	}
+	// Log the statistics of the last, partial interval.
+	flushStats()
 }
@@ -2,43 +2,227 @@ package main
 
 // This code handles periodic statistics logging.
 //
-// The only thing it keeps track of is how many connections had the client_ip
-// parameter. Write true to statsChannel to record a connection with client_ip;
-// write false for without.
+// It keeps track of how many connections had the client_ip parameter, of how
+// many connections were domain-fronted or direct, and of how many unique client
+// IP addresses were seen from each country. Call stats.recordConnection with
+// the client address (the connection's RemoteAddr, which is empty when there
+// was no client_ip) and the connection's origin to record a connection. Call
+// flushStats to log the statistics collected so far without waiting for the
+// end of the interval.
 
 import (
+	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
+	sf "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/server/lib"
 )
 
 const (
-	statsInterval = 24 * time.Hour
+	defaultStatsInterval = 24 * time.Hour
+
+	// unknownCountry is the country of client IP addresses that cannot be
+	// looked up, for example because no GeoIP database is loaded.
+	unknownCountry = "unknown"
 )
 
 var (
-	statsChannel = make(chan bool)
+	// stats holds the statistics of the current interval. It is set in main
+	// before any connections are handled.
+	stats *serverStats
+
+	// flushChannel receives a channel to close once the stats have been
+	// logged and reset.
+	flushChannel = make(chan chan struct{})
 )
 
-func statsThread() {
-	var numClientIP, numConnections uint64
-	prevTime := time.Now()
-	deadline := time.After(statsInterval)
+// serverStats holds the connection statistics of the current interval.
+type serverStats struct {
+	geoipdb *geoip.Geoip
+
+	lock           sync.Mutex // protects the following:
+	start          time.Time
+	numClientIP    uint64
+	numConnections uint64
+	numByOrigin    map[sf.ConnOrigin]uint64
+	ipsByCountry   map[string]map[string]struct{}
+}
+
+// statsSnapshot is a copy of the statistics of an interval.
+type statsSnapshot struct {
+	// Start is the time at which the interval started.
+	Start          time.Time
+	NumClientIP    uint64
+	NumConnections uint64
+	// ConnectionsByOrigin is the number of connections with each origin,
+	// keyed by the origin's name.
+	ConnectionsByOrigin map[string]uint64
+	// ClientIPsByCountry is the number of unique client IP addresses seen
+	// from each country.
+	ClientIPsByCountry map[string]int
+}
+
+// newServerStats returns an empty serverStats that uses geoipdb, which may be
+// nil, to find the country of client IP addresses.
+func newServerStats(geoipdb *geoip.Geoip) *serverStats {
+	return &serverStats{
+		geoipdb:      geoipdb,
+		start:        time.Now(),
+		numByOrigin:  make(map[sf.ConnOrigin]uint64),
+		ipsByCountry: make(map[string]map[string]struct{}),
+	}
+}
+
+// recordConnection records a connection with the given origin from the client
+// at addr, which is empty if the client address is not known.
+func (s *serverStats) recordConnection(addr string, origin sf.ConnOrigin) {
+	var country string
+	if addr != "" {
+		country = clientCountry(s.geoipdb, addr)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if addr != "" {
+		s.numClientIP++
+		if s.ipsByCountry[country] == nil {
+			s.ipsByCountry[country] = make(map[string]struct{})
+		}
+		s.ipsByCountry[country][addr] = struct{}{}
+	}
+	s.numConnections++
+	s.numByOrigin[origin]++
+}
+
+// Snapshot returns the statistics of the current interval so far.
+func (s *serverStats) Snapshot() statsSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.snapshotLocked()
+}
+
+func (s *serverStats) snapshotLocked() statsSnapshot {
+	ipsByCountry := make(map[string]int, len(s.ipsByCountry))
+	for country, ips := range s.ipsByCountry {
+		ipsByCountry[country] = len(ips)
+	}
+	byOrigin := make(map[string]uint64, len(s.numByOrigin))
+	for origin, n := range s.numByOrigin {
+		byOrigin[origin.String()] = n
+	}
+	return statsSnapshot{
+		Start:               s.start,
+		NumClientIP:         s.numClientIP,
+		NumConnections:      s.numConnections,
+		ConnectionsByOrigin: byOrigin,
+		ClientIPsByCountry:  ipsByCountry,
+	}
+}
+
+// reset starts a new interval and returns the statistics of the previous one.
+func (s *serverStats) reset() statsSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snapshot := s.snapshotLocked()
+	s.start = time.Now()
+	s.numClientIP = 0
+	s.numConnections = 0
+	s.numByOrigin = make(map[sf.ConnOrigin]uint64)
+	s.ipsByCountry = make(map[string]map[string]struct{})
+	return snapshot
+}
+
+// flushStats logs the statistics collected so far and starts a new interval.
+// It returns once they have been logged.
+func flushStats() {
+	done := make(chan struct{})
+	flushChannel <- done
+	<-done
+}
+
+// clientCountry returns the country code of the client at addr, using
+// geoipdb, which may be nil.
+func clientCountry(geoipdb *geoip.Geoip, addr string) string {
+	if geoipdb == nil {
+		return unknownCountry
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return unknownCountry
+	}
+	country, ok := geoipdb.GetCountryByAddr(ip)
+	if !ok {
+		return unknownCountry
+	}
+	return country
+}
+
+// formatCountryCounts formats the number of unique IP addresses per country,
+// most common first.
+func formatCountryCounts(ipsByCountry map[string]int) string {
+	countries := make([]string, 0, len(ipsByCountry))
+	for country := range ipsByCountry {
+		countries = append(countries, country)
+	}
+	sort.Slice(countries, func(i, j int) bool {
+		ni, nj := ipsByCountry[countries[i]], ipsByCountry[countries[j]]
+		if ni != nj {
+			return ni > nj
+		}
+		return countries[i] < countries[j]
+	})
+	parts := make([]string, 0, len(countries))
+	for _, country := range countries {
+		parts = append(parts, fmt.Sprintf("%s=%d", country, ipsByCountry[country]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatOriginCounts formats the number of connections per origin, direct
+// first.
+func formatOriginCounts(byOrigin map[string]uint64) string {
+	parts := make([]string, 0, 2)
+	for _, origin := range []sf.ConnOrigin{sf.OriginDirect, sf.OriginFronted} {
+		parts = append(parts, fmt.Sprintf("%s=%d", origin, byOrigin[origin.String()]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// logStats logs the statistics of the interval that ended at end.
+func logStats(snapshot statsSnapshot, end time.Time) {
+	log.Printf("in the past %.f s, %d/%d connections had client_ip",
+		(end.Sub(snapshot.Start)).Seconds(),
+		snapshot.NumClientIP, snapshot.NumConnections)
+	log.Printf("in the past %.f s, connections by origin: %s",
+		(end.Sub(snapshot.Start)).Seconds(),
+		formatOriginCounts(snapshot.ConnectionsByOrigin))
+	log.Printf("in the past %.f s, unique client IPs by country: %s",
+		(end.Sub(snapshot.Start)).Seconds(),
+		formatCountryCounts(snapshot.ClientIPsByCountry))
+}
+
+// statsThread logs and resets stats every interval, or when flushed.
+func statsThread(stats *serverStats, interval time.Duration) {
+	deadline := time.After(interval)
 	for {
+		var done chan struct{}
 		select {
-		case v := <-statsChannel:
-			if v {
-				numClientIP++
-			}
-			numConnections++
 		case <-deadline:
-			now := time.Now()
-			log.Printf("in the past %.f s, %d/%d connections had client_ip",
-				(now.Sub(prevTime)).Seconds(),
-				numClientIP, numConnections)
-			numClientIP = 0
-			numConnections = 0
-			prevTime = now
-			deadline = time.After(statsInterval)
+		case done = <-flushChannel:
+		}
+		logStats(stats.reset(), time.Now())
+		deadline = time.After(interval)
+		if done != nil {
+			close(done)
 		}
 	}
 }
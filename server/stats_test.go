@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	sf "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/server/lib"
+)
+
+func TestServerStatsSnapshot(t *testing.T) {
+	s := newServerStats(nil)
+	s.recordConnection("1.2.3.4:1", sf.OriginDirect)
+	s.recordConnection("1.2.3.4:1", sf.OriginFronted)
+	s.recordConnection("5.6.7.8:1", sf.OriginDirect)
+	s.recordConnection("", sf.OriginFronted)
+
+	snapshot := s.Snapshot()
+	if snapshot.NumClientIP != 3 || snapshot.NumConnections != 4 {
+		t.Errorf("got %d/%d connections with client_ip, expected 3/4",
+			snapshot.NumClientIP, snapshot.NumConnections)
+	}
+	if direct, fronted := snapshot.ConnectionsByOrigin["direct"], snapshot.ConnectionsByOrigin["fronted"]; direct != 2 || fronted != 2 {
+		t.Errorf("got %d direct and %d fronted connections, expected 2 and 2", direct, fronted)
+	}
+	if n := snapshot.ClientIPsByCountry[unknownCountry]; n != 2 {
+		t.Errorf("got %d unique client IPs, expected 2", n)
+	}
+
+	// Taking a snapshot does not reset the counts, but reset does.
+	if previous := s.reset(); previous.NumConnections != 4 || previous.Start != snapshot.Start {
+		t.Errorf("reset returned %+v, expected %+v", previous, snapshot)
+	}
+	snapshot = s.Snapshot()
+	if snapshot.NumClientIP != 0 || snapshot.NumConnections != 0 || len(snapshot.ConnectionsByOrigin) != 0 ||
+		len(snapshot.ClientIPsByCountry) != 0 {
+		t.Errorf("got %+v after reset, expected empty counts", snapshot)
+	}
+}